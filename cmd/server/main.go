@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"time"
 
 	"github.com/vncats/otel-demo/internal/server"
 
@@ -9,8 +10,10 @@ import (
 	"github.com/vncats/otel-demo/internal/message"
 	"github.com/vncats/otel-demo/internal/store"
 	"github.com/vncats/otel-demo/internal/workflow"
+	"github.com/vncats/otel-demo/pkg/circuitbreaker"
 	"github.com/vncats/otel-demo/pkg/otel/metric"
 	"github.com/vncats/otel-demo/pkg/otel/sdk"
+	"github.com/vncats/otel-demo/pkg/retry"
 )
 
 func main() {
@@ -40,15 +43,39 @@ func main() {
 		panic(err)
 	}
 
-	// New cache
-	cs, err := cache.NewCache("redis://:password@localhost:6379/1", st)
+	// Fail fast while the database is down
+	dbBreaker, err := circuitbreaker.New(circuitbreaker.Options{
+		Name:      "mysql",
+		IsFailure: store.IsBreakerFailure,
+	})
+	if err != nil {
+		panic(err)
+	}
+	// Hedge slow reads, within 10% of extra queries
+	hst := store.NewHedgedStore(st, retry.HedgeConfig{
+		Delay:  50 * time.Millisecond,
+		Budget: retry.NewBudget(retry.BudgetOptions{Name: "mysql"}),
+	})
+	bst := store.NewBreakerStore(hst, dbBreaker)
+
+	// New cache, failing fast to the store while Redis is down
+	cacheBreaker, err := circuitbreaker.New(circuitbreaker.Options{Name: "redis"})
+	if err != nil {
+		panic(err)
+	}
+	cs, err := cache.NewCache("redis://:password@localhost:6379/1", bst, cacheBreaker)
 	if err != nil {
 		panic(err)
 	}
 	defer cs.Close()
 
-	// New consumer
-	consumer, err := message.NewStatsConsumer(st)
+	// Deduplicate consumed messages, purging the expired ones
+	dedup := st.DedupStore()
+	dedup.Start()
+	defer dedup.Stop()
+
+	// New consumer, failing fast while the database is down. Its writes are not hedged.
+	consumer, err := message.NewStatsConsumer(store.NewBreakerStore(st, dbBreaker), cs, dedup)
 	if err != nil {
 		panic(err)
 	}
@@ -63,6 +90,17 @@ func main() {
 	producer.Start()
 	defer producer.Stop()
 
+	producerBreaker, err := circuitbreaker.New(circuitbreaker.Options{Name: "kafka"})
+	if err != nil {
+		panic(err)
+	}
+	bp := message.NewBreakerProducer(producer, producerBreaker)
+
+	// New outbox relay, stopped before the producer
+	relay := message.NewOutboxRelay(bst, bp)
+	relay.Start()
+	defer relay.Stop()
+
 	tc, err := workflow.NewClient()
 	if err != nil {
 		panic(err)
@@ -76,7 +114,7 @@ func main() {
 	}
 	defer w.Stop()
 
-	h := server.NewHandler(st, producer, cs, tc)
+	h := server.NewHandler(bst, cs, tc)
 	s := server.NewServer(h)
 	s.Start()
 }
@@ -2,25 +2,40 @@ package cache
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"time"
 
 	"github.com/redis/go-redis/extra/redisotel/v9"
 	"github.com/redis/go-redis/v9"
 	"github.com/vncats/otel-demo/internal/store"
+	pcache "github.com/vncats/otel-demo/pkg/cache"
+	"github.com/vncats/otel-demo/pkg/circuitbreaker"
+	"gorm.io/gorm"
 )
 
-var ErrCacheMiss = errors.New("cache miss")
+const (
+	moviesTTL        = 5 * time.Second
+	movieTTL         = time.Minute
+	movieNegativeTTL = 10 * time.Second
+	movieMemorySize  = 1000
+	// movieMemoryTTL bounds the staleness of a movie when an invalidation is missed.
+	movieMemoryTTL = 10 * time.Second
+)
 
 type ICache interface {
 	GetMovies(ctx context.Context) ([]*store.Movie, error)
+	// GetMovie returns pcache.ErrNotFound if the movie does not exist.
+	GetMovie(ctx context.Context, id int) (*store.Movie, error)
+	// InvalidateMovie evicts the cached values which include the movie, on every instance.
+	InvalidateMovie(ctx context.Context, id int) error
 	Close() error
 }
 
 var _ ICache = (*Cache)(nil)
 
-func NewCache(redisURI string, st store.IStore) (*Cache, error) {
+// NewCache returns a cache of the movies of st. Redis calls go through breaker, so that
+// reads fall back to st without waiting on Redis while it is down.
+func NewCache(redisURI string, st store.IStore, breaker *circuitbreaker.Breaker) (*Cache, error) {
 	opt, err := redis.ParseURL(redisURI)
 	if err != nil {
 		return nil, err
@@ -34,60 +49,82 @@ func NewCache(redisURI string, st store.IStore) (*Cache, error) {
 		return nil, err
 	}
 
-	return &Cache{store: st, client: rdb}, nil
-}
-
-type Cache struct {
-	store  store.IStore
-	client *redis.Client
-}
-
-func (c *Cache) GetMovies(ctx context.Context) ([]*store.Movie, error) {
-	var movies []*store.Movie
-	err := c.get(ctx, "movies", &movies)
-
-	if err == nil {
-		return movies, nil
-	}
-	if !errors.Is(err, ErrCacheMiss) {
+	invalidator := pcache.NewInvalidator(rdb, pcache.InvalidatorOptions{Breaker: breaker})
+
+	// Redis only spares the store, so reads fall back to the store when Redis fails, and
+	// to the last good values when both fail
+	movies, err := pcache.New[[]*store.Movie](rdb, pcache.Options{
+		Name:         "movies",
+		TTL:          moviesTTL,
+		EarlyRefresh: 1,
+		Invalidator:  invalidator,
+		MemorySize:   1,
+		FailOpen:     true,
+		Breaker:      breaker,
+		StaleSize:    1,
+		Codec:        pcache.MsgpackCodec{},
+		Compression:  pcache.CompressionZstd,
+	})
+	if err != nil {
 		return nil, err
 	}
 
-	movies, err = c.store.GetMovies(ctx)
+	movie, err := pcache.New[*store.Movie](rdb, pcache.Options{
+		Name:         "movie",
+		TTL:          movieTTL,
+		NegativeTTL:  movieNegativeTTL,
+		EarlyRefresh: 1,
+		IsNotFound:   isNotFound,
+		Invalidator:  invalidator,
+		MemorySize:   movieMemorySize,
+		MemoryTTL:    movieMemoryTTL,
+		FailOpen:     true,
+		Breaker:      breaker,
+		StaleSize:    movieMemorySize,
+		Codec:        pcache.MsgpackCodec{},
+	})
 	if err != nil {
 		return nil, err
 	}
-	if len(movies) > 0 {
-		err = c.set(ctx, "movies", movies, 5*time.Second)
-		if err != nil {
-			return nil, err
-		}
-	}
 
-	return movies, nil
+	invalidator.Start()
+
+	return &Cache{
+		store:       st,
+		client:      rdb,
+		invalidator: invalidator,
+		movies:      movies,
+		movie:       movie,
+	}, nil
 }
 
-func (c *Cache) Close() error {
-	return c.client.Close()
+type Cache struct {
+	store       store.IStore
+	client      *redis.Client
+	invalidator *pcache.Invalidator
+	movies      *pcache.Cache[[]*store.Movie]
+	movie       *pcache.Cache[*store.Movie]
 }
 
-func (c *Cache) get(ctx context.Context, key string, out interface{}) error {
-	v, err := c.client.Get(ctx, key).Result()
-	if errors.Is(err, redis.Nil) {
-		return ErrCacheMiss
-	}
-	if err != nil {
-		return err
-	}
+func (c *Cache) GetMovies(ctx context.Context) ([]*store.Movie, error) {
+	return c.movies.Get(ctx, c.movies.Key("all"), c.store.GetMovies)
+}
 
-	return json.Unmarshal([]byte(v), &out)
+func (c *Cache) GetMovie(ctx context.Context, id int) (*store.Movie, error) {
+	return c.movie.Get(ctx, c.movie.Key(id), func(ctx context.Context) (*store.Movie, error) {
+		return c.store.GetMovie(ctx, id)
+	})
 }
 
-func (c *Cache) set(ctx context.Context, key string, value interface{}, exp time.Duration) error {
-	b, err := json.Marshal(value)
-	if err != nil {
-		return err
-	}
+func (c *Cache) InvalidateMovie(ctx context.Context, id int) error {
+	return c.invalidator.Invalidate(ctx, c.movies.Key("all"), c.movie.Key(id))
+}
+
+func (c *Cache) Close() error {
+	c.invalidator.Stop()
+	return c.client.Close()
+}
 
-	return c.client.Set(ctx, key, string(b), exp).Err()
+func isNotFound(err error) bool {
+	return errors.Is(err, gorm.ErrRecordNotFound)
 }
@@ -0,0 +1,53 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/vncats/otel-demo/pkg/kafka"
+)
+
+const (
+	dedupKeyPrefix = "dedup:"
+
+	dedupInProgress = "in_progress"
+	dedupProcessed  = "processed"
+)
+
+// DedupStore returns a kafka.DedupStore keeping the IDs of processed messages in Redis.
+func (c *Cache) DedupStore() kafka.DedupStore {
+	return &dedupStore{client: c.client}
+}
+
+type dedupStore struct {
+	client *redis.Client
+}
+
+func (s *dedupStore) Claim(ctx context.Context, id string, ttl time.Duration) (bool, bool, error) {
+	key := dedupKeyPrefix + id
+	claimed, err := s.client.SetNX(ctx, key, dedupInProgress, ttl).Result()
+	if err != nil || claimed {
+		return claimed, false, err
+	}
+
+	state, err := s.client.Get(ctx, key).Result()
+	if errors.Is(err, redis.Nil) {
+		// released or expired meanwhile, so the message is retried as if in progress
+		return false, false, nil
+	}
+	if err != nil {
+		return false, false, err
+	}
+
+	return false, state == dedupProcessed, nil
+}
+
+func (s *dedupStore) Complete(ctx context.Context, id string, ttl time.Duration) error {
+	return s.client.Set(ctx, dedupKeyPrefix+id, dedupProcessed, ttl).Err()
+}
+
+func (s *dedupStore) Release(ctx context.Context, id string) error {
+	return s.client.Del(ctx, dedupKeyPrefix+id).Err()
+}
@@ -0,0 +1,43 @@
+package message
+
+import (
+	"context"
+
+	ckafka "github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/vncats/otel-demo/pkg/circuitbreaker"
+	"github.com/vncats/otel-demo/pkg/kafka"
+)
+
+// BreakerProducer fails fast with circuitbreaker.ErrOpen while producing keeps failing.
+// Only the failures reported by the Produce calls count, not the ones of asynchronous
+// deliveries.
+type BreakerProducer struct {
+	producer IProducer
+	breaker  *circuitbreaker.Breaker
+}
+
+var _ IProducer = (*BreakerProducer)(nil)
+
+func NewBreakerProducer(p IProducer, breaker *circuitbreaker.Breaker) *BreakerProducer {
+	return &BreakerProducer{producer: p, breaker: breaker}
+}
+
+func (p *BreakerProducer) Produce(ctx context.Context, topic string, key string, value any, opts ...kafka.MessageOption) (*ckafka.Message, error) {
+	return circuitbreaker.Do(ctx, p.breaker, func(ctx context.Context) (*ckafka.Message, error) {
+		return p.producer.Produce(ctx, topic, key, value, opts...)
+	})
+}
+
+func (p *BreakerProducer) ProduceAsync(ctx context.Context, topic string, key string, value any, opts ...kafka.MessageOption) (*kafka.Delivery, error) {
+	return circuitbreaker.Do(ctx, p.breaker, func(ctx context.Context) (*kafka.Delivery, error) {
+		return p.producer.ProduceAsync(ctx, topic, key, value, opts...)
+	})
+}
+
+func (p *BreakerProducer) Start() {
+	p.producer.Start()
+}
+
+func (p *BreakerProducer) Stop() {
+	p.producer.Stop()
+}
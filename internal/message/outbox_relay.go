@@ -0,0 +1,158 @@
+package message
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/vncats/otel-demo/internal/store"
+	"github.com/vncats/otel-demo/pkg/kafka"
+	"github.com/vncats/otel-demo/pkg/otel/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	outboxPollInterval = time.Second
+	outboxBatchSize    = 100
+	outboxRetryMin     = time.Second
+	outboxRetryMax     = 5 * time.Minute
+	// outboxDeliveryTimeout bounds the wait for a delivery report, including while
+	// draining on stop, and must be shorter than outboxLease.
+	outboxDeliveryTimeout = 30 * time.Second
+	// outboxLease bounds how long a claimed message is hidden from other relays, which
+	// must exceed the time taken to publish a batch.
+	outboxLease = time.Minute
+	// sent messages are kept for a while for troubleshooting, then purged
+	outboxPurgeInterval = time.Hour
+	outboxRetention     = 24 * time.Hour
+)
+
+// OutboxRelay publishes the pending outbox messages of the store, retrying failed ones
+// with an exponential backoff. Messages are published at least once.
+type OutboxRelay struct {
+	store    store.IStore
+	producer IProducer
+
+	wg     sync.WaitGroup
+	cancel context.CancelFunc
+}
+
+func NewOutboxRelay(st store.IStore, p IProducer) *OutboxRelay {
+	return &OutboxRelay{store: st, producer: p}
+}
+
+func (r *OutboxRelay) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	r.cancel = cancel
+	r.wg.Add(1)
+
+	log.Info(ctx, "Starting outbox relay")
+	go func() {
+		defer r.wg.Done()
+
+		ticker := time.NewTicker(outboxPollInterval)
+		defer ticker.Stop()
+		purgeTicker := time.NewTicker(outboxPurgeInterval)
+		defer purgeTicker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				r.relay(ctx)
+			case <-purgeTicker.C:
+				r.purge(ctx)
+			}
+		}
+	}()
+}
+
+func (r *OutboxRelay) Stop() {
+	log.Info(context.Background(), "Stopping outbox relay")
+	r.cancel()
+	r.wg.Wait()
+}
+
+// relay publishes a batch of pending messages, waiting for all of them to be delivered.
+// Messages already enqueued when ctx is cancelled are still waited for, up to
+// outboxDeliveryTimeout, so that their outcome is recorded rather than failed.
+func (r *OutboxRelay) relay(ctx context.Context) {
+	msgs, err := r.store.ClaimPendingOutbox(ctx, outboxBatchSize, outboxLease)
+	if err != nil {
+		log.Error(ctx, "failed to get pending outbox messages", "error", err)
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, msg := range msgs {
+		msgCtx, span := tracer.Start(msg.Context(ctx), "relay outbox message", trace.WithAttributes(
+			attribute.Int("outbox.id", msg.ID),
+			attribute.Int("outbox.attempts", msg.Attempts),
+		))
+
+		// the row ID identifies the message however many times it is relayed
+		delivery, err := r.producer.ProduceAsync(msgCtx, msg.Topic, msg.Key, json.RawMessage(msg.Payload),
+			kafka.WithMessageID(outboxMessageID(msg)))
+		if err != nil {
+			r.finish(msgCtx, span, msg, err)
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			waitCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), outboxDeliveryTimeout)
+			defer cancel()
+			_, err := delivery.Wait(waitCtx)
+			r.finish(msgCtx, span, msg, err)
+		}()
+	}
+	wg.Wait()
+}
+
+// purge deletes the messages sent before the retention period.
+func (r *OutboxRelay) purge(ctx context.Context) {
+	if err := r.store.PurgeSentOutbox(ctx, time.Now().Add(-outboxRetention)); err != nil {
+		log.Error(ctx, "failed to purge sent outbox messages", "error", err)
+	}
+}
+
+// finish records the outcome of publishing msg and ends its span.
+func (r *OutboxRelay) finish(ctx context.Context, span trace.Span, msg *store.OutboxMessage, err error) {
+	defer span.End()
+
+	// the outcome is recorded even when the relay stops while waiting for the delivery
+	ctx = context.WithoutCancel(ctx)
+	if err == nil {
+		if err = r.store.MarkOutboxSent(ctx, msg.ID); err != nil {
+			// the message is published again by the next relay
+			log.Error(ctx, "failed to mark outbox message as sent", "error", err, "outbox_id", msg.ID)
+		}
+		return
+	}
+
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+
+	nextAttempt := time.Now().Add(outboxRetryDelay(msg.Attempts))
+	log.Error(ctx, "failed to relay outbox message", "error", err, "outbox_id", msg.ID, "next_attempt", nextAttempt)
+	if err = r.store.MarkOutboxFailed(ctx, msg.ID, err, nextAttempt); err != nil {
+		log.Error(ctx, "failed to mark outbox message as failed", "error", err, "outbox_id", msg.ID)
+	}
+}
+
+func outboxMessageID(msg *store.OutboxMessage) string {
+	return "outbox:" + strconv.Itoa(msg.ID)
+}
+
+func outboxRetryDelay(attempts int) time.Duration {
+	delay := outboxRetryMin
+	for i := 0; i < attempts && delay < outboxRetryMax; i++ {
+		delay *= 2
+	}
+	return min(delay, outboxRetryMax)
+}
@@ -8,7 +8,8 @@ import (
 )
 
 type IProducer interface {
-	Produce(ctx context.Context, topic string, key string, value any) (*ckafka.Message, error)
+	Produce(ctx context.Context, topic string, key string, value any, opts ...kafka.MessageOption) (*ckafka.Message, error)
+	ProduceAsync(ctx context.Context, topic string, key string, value any, opts ...kafka.MessageOption) (*kafka.Delivery, error)
 	Start()
 	Stop()
 }
@@ -31,8 +32,12 @@ type Producer struct {
 	producer *kafka.Producer
 }
 
-func (p *Producer) Produce(ctx context.Context, topic string, key string, value any) (*ckafka.Message, error) {
-	return p.producer.Produce(topic, key, value, kafka.WithTraceContext(ctx))
+func (p *Producer) Produce(ctx context.Context, topic string, key string, value any, opts ...kafka.MessageOption) (*ckafka.Message, error) {
+	return p.producer.Produce(topic, key, value, append(opts, kafka.WithTraceContext(ctx))...)
+}
+
+func (p *Producer) ProduceAsync(ctx context.Context, topic string, key string, value any, opts ...kafka.MessageOption) (*kafka.Delivery, error) {
+	return p.producer.ProduceAsync(topic, key, value, append(opts, kafka.WithTraceContext(ctx))...)
 }
 
 func (p *Producer) Start() {
@@ -1,30 +1,74 @@
 package message
 
 import (
-	"encoding/json"
+	"context"
 	"math"
+	"slices"
 	"time"
 
 	ckafka "github.com/confluentinc/confluent-kafka-go/v2/kafka"
 	"github.com/vncats/otel-demo/internal/store"
 	"github.com/vncats/otel-demo/pkg/kafka"
+	"github.com/vncats/otel-demo/pkg/kafka/tracing"
+	"github.com/vncats/otel-demo/pkg/otel/log"
 	"github.com/vncats/otel-demo/pkg/retry"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+const (
+	RatingCreatedTopic    = "private.movie.rating.created"
+	ratingCreatedDLQTopic = "private.movie.rating.created.dlq"
+	statsConsumerGroup    = "movie_stats_consumer_group"
+)
+
+// MovieInvalidator evicts the cached values which include a movie.
+type MovieInvalidator interface {
+	InvalidateMovie(ctx context.Context, movieID int) error
+}
+
 type StatsConsumer struct {
 	*kafka.Consumer
+	dlqProducer *kafka.Producer
 }
 
-// NewStatsConsumer returns new instance
-func NewStatsConsumer(st store.IStore) (*StatsConsumer, error) {
-	handler := statsHandler{store: st}
+// NewStatsConsumer returns new instance. The cached values of a movie are invalidated
+// with inv once its stats are updated, and ratings already processed are recorded in
+// dedup, so that redelivered ratings do not update the stats again.
+func NewStatsConsumer(st store.IStore, inv MovieInvalidator, dedup kafka.DedupStore) (*StatsConsumer, error) {
+	handler := statsHandler{store: st, invalidator: inv}
+	batchHandler, err := kafka.DeduplicateBatch(handler.handleBatch, kafka.DedupOptions{
+		Store:     dedup,
+		Namespace: statsConsumerGroup,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	dlqProducer, err := kafka.NewProducer(kafka.ProducerOptions{
+		Brokers:       "localhost:9092",
+		EnableTracing: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
 	consumer, err := kafka.NewConsumer(kafka.ConsumerOptions{
 		Brokers:       "localhost:9092",
-		Group:         "movie_stats_consumer_group",
-		Topics:        []string{"private.movie.rating.created"},
+		Group:         statsConsumerGroup,
+		Topics:        []string{RatingCreatedTopic},
 		Offset:        kafka.OffsetEarliest,
 		EnableTracing: true,
-		MessageHandler: kafka.HandleWithRetry(handler.handleMessage, retry.Config{
+		CommitMode:    kafka.CommitModeSync,
+		DeadLetter: &kafka.DeadLetterOptions{
+			Topic:    ratingCreatedDLQTopic,
+			Producer: dlqProducer,
+		},
+		AssignmentStrategy: kafka.AssignmentCooperativeSticky,
+		BatchSize:          100,
+		BatchTimeout:       time.Second,
+		BatchHandler: kafka.HandleBatchWithRetry(batchHandler, retry.Config{
+			Name:            "update stats",
 			InitialInterval: 5 * time.Second,
 			MaxInterval:     30 * time.Second,
 			Multiplier:      2,
@@ -32,26 +76,73 @@ func NewStatsConsumer(st store.IStore) (*StatsConsumer, error) {
 		}),
 	})
 	if err != nil {
+		dlqProducer.Stop()
 		return nil, err
 	}
 
-	return &StatsConsumer{consumer}, nil
+	return &StatsConsumer{Consumer: consumer, dlqProducer: dlqProducer}, nil
+}
+
+func (c *StatsConsumer) Start() {
+	c.dlqProducer.Start()
+	c.Consumer.Start()
+}
+
+func (c *StatsConsumer) Stop() {
+	c.Consumer.Stop()
+	c.dlqProducer.Stop()
 }
 
 type statsHandler struct {
-	store store.IStore
+	store       store.IStore
+	invalidator MovieInvalidator
 }
 
-func (s *statsHandler) handleMessage(msg *ckafka.Message) error {
-	ctx, span := startSpan(msg, "handle message")
-	defer span.End()
+// handleBatch recomputes the stats of every movie rated in msgs, once per movie. A
+// message which does not decode, or whose movie failed to update, fails on its own
+// without failing the rest of the batch.
+func (s *statsHandler) handleBatch(ctx context.Context, msgs []*ckafka.Message) error {
+	batchErr := &kafka.BatchError{}
+	var movieIDs []int
+	ratings := make(map[int][]*ckafka.Message)
+	for _, msg := range msgs {
+		rating, err := kafka.Decode[store.Rating](kafka.JSONSerde{}, msg)
+		if err != nil {
+			// a malformed message never decodes, so it is not retried
+			batchErr.Add(msg, retry.Permanent(err))
+			continue
+		}
+		if !slices.Contains(movieIDs, rating.MovieID) {
+			movieIDs = append(movieIDs, rating.MovieID)
+		}
+		ratings[rating.MovieID] = append(ratings[rating.MovieID], msg)
+	}
 
-	rating := store.Rating{}
-	if err := json.Unmarshal(msg.Value, &rating); err != nil {
-		return err
+	for _, movieID := range movieIDs {
+		if err := s.updateStats(ctx, movieID, ratings[movieID]); err != nil {
+			for _, msg := range ratings[movieID] {
+				batchErr.Add(msg, err)
+			}
+		}
+	}
+
+	return batchErr.Err()
+}
+
+// updateStats recomputes the stats of a movie and invalidates its cached values, within a
+// span linked to the ratings which triggered it.
+func (s *statsHandler) updateStats(ctx context.Context, movieID int, ratings []*ckafka.Message) error {
+	links := make([]trace.Link, 0, len(ratings))
+	for _, msg := range ratings {
+		links = append(links, trace.LinkFromContext(tracing.ProducerContextFromMessage(context.Background(), msg)))
 	}
+	ctx, span := tracer.Start(ctx, "update stats",
+		trace.WithAttributes(attribute.Int("movie.id", movieID)),
+		trace.WithLinks(links...),
+	)
+	defer span.End()
 
-	counts, err := s.store.GetRatingCounts(ctx, rating.MovieID)
+	counts, err := s.store.GetRatingCounts(ctx, movieID)
 	if err != nil {
 		return err
 	}
@@ -71,5 +162,15 @@ func (s *statsHandler) handleMessage(msg *ckafka.Message) error {
 	}
 	stats.AvgScore = math.Round(float64(scoreSum)*100/float64(stats.NumRating)) / 100
 
-	return s.store.UpdateStats(ctx, rating.MovieID, stats)
+	if err := s.store.UpdateStats(ctx, movieID, stats); err != nil {
+		return err
+	}
+
+	// the stats are committed, so failing here would only recompute them; the cached
+	// values expire on their own instead
+	if err := s.invalidator.InvalidateMovie(ctx, movieID); err != nil {
+		log.Error(ctx, "failed to invalidate cached movie", "error", err, "movie_id", movieID)
+	}
+
+	return nil
 }
@@ -2,6 +2,7 @@ package server
 
 import (
 	"context"
+	"errors"
 	"net/http"
 	"strconv"
 
@@ -11,6 +12,8 @@ import (
 	"github.com/vncats/otel-demo/internal/message"
 	"github.com/vncats/otel-demo/internal/store"
 	"github.com/vncats/otel-demo/internal/workflow"
+	pcache "github.com/vncats/otel-demo/pkg/cache"
+	"github.com/vncats/otel-demo/pkg/circuitbreaker"
 	"github.com/vncats/otel-demo/pkg/otel/log"
 	"github.com/vncats/otel-demo/pkg/prim"
 	"go.temporal.io/sdk/client"
@@ -18,6 +21,7 @@ import (
 
 type IHandler interface {
 	GetMovies(ctx *RequestContext)
+	GetMovie(ctx *RequestContext)
 	RateMovie(ctx *RequestContext)
 	TrackUserAction(ctx context.Context, payload prim.Map)
 }
@@ -26,6 +30,10 @@ type GetMoviesResp struct {
 	Movies []*store.Movie `json:"movies"`
 }
 
+type GetMovieReq struct {
+	ID int `validate:"required,gt=0"`
+}
+
 type RateMovieReq struct {
 	ID    int    `validate:"required,gt=0"`
 	UID   string `validate:"required"`
@@ -40,13 +48,11 @@ var _ IHandler = (*Handler)(nil)
 
 func NewHandler(
 	st store.IStore,
-	p message.IProducer,
 	cache cache.ICache,
 	tc client.Client,
 ) *Handler {
 	return &Handler{
 		store:     st,
-		producer:  p,
 		cache:     cache,
 		wfClient:  tc,
 		validator: validator.New(),
@@ -55,7 +61,6 @@ func NewHandler(
 
 type Handler struct {
 	store     store.IStore
-	producer  message.IProducer
 	cache     cache.ICache
 	wfClient  client.Client
 	validator *validator.Validate
@@ -64,7 +69,7 @@ type Handler struct {
 func (h *Handler) GetMovies(ctx *RequestContext) {
 	movies, err := h.cache.GetMovies(ctx.Context())
 	if err != nil {
-		ctx.SendError()
+		sendError(ctx, err)
 		return
 	}
 
@@ -77,6 +82,29 @@ func (h *Handler) GetMovies(ctx *RequestContext) {
 	ctx.SendSuccess("get movies successfully", resp)
 }
 
+func (h *Handler) GetMovie(ctx *RequestContext) {
+	req := &GetMovieReq{
+		ID: parseInt(ctx.Request.PathValue("id")),
+	}
+	if err := h.validator.Struct(req); err != nil {
+		log.Error(ctx.Context(), "invalid request", "error", err)
+		ctx.SendBadRequest()
+		return
+	}
+
+	movie, err := h.cache.GetMovie(ctx.Context(), req.ID)
+	if errors.Is(err, pcache.ErrNotFound) {
+		ctx.SendNotFound()
+		return
+	}
+	if err != nil {
+		sendError(ctx, err)
+		return
+	}
+
+	ctx.SendSuccess("get movie successfully", movie)
+}
+
 func (h *Handler) RateMovie(ctx *RequestContext) {
 	req := &RateMovieReq{
 		UID:   getUserID(ctx.Request),
@@ -94,15 +122,11 @@ func (h *Handler) RateMovie(ctx *RequestContext) {
 		UID:     req.UID,
 		Score:   req.Score,
 	}
-	err := h.store.CreateRating(ctx.Context(), rating)
+	// the event is published by the outbox relay once the rating is committed
+	event := store.NewOutboxMessage(ctx.Context(), message.RatingCreatedTopic, strconv.Itoa(req.ID), rating)
+	err := h.store.CreateRating(ctx.Context(), rating, event)
 	if err != nil {
-		ctx.SendError()
-		return
-	}
-
-	_, err = h.producer.Produce(ctx.Context(), "private.movie.rating.created", strconv.Itoa(req.ID), rating)
-	if err != nil {
-		ctx.SendError()
+		sendError(ctx, err)
 		return
 	}
 
@@ -116,6 +140,18 @@ func (h *Handler) TrackUserAction(ctx context.Context, payload prim.Map) {
 	}, workflow.TrackUserActionWorkflow, payload)
 }
 
+// sendError responds with 503 when a dependency is known to be down, and 500 otherwise.
+func sendError(ctx *RequestContext, err error) {
+	if errors.Is(err, circuitbreaker.ErrOpen) {
+		log.Warn(ctx.Context(), "dependency unavailable", "error", err)
+		ctx.SendServiceUnavailable()
+		return
+	}
+
+	log.Error(ctx.Context(), "request failed", "error", err)
+	ctx.SendError()
+}
+
 func parseInt(str string) int {
 	v, _ := strconv.Atoi(str)
 	return v
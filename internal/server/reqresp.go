@@ -38,6 +38,13 @@ func (r *RequestContext) SendError() {
 	})
 }
 
+func (r *RequestContext) SendServiceUnavailable() {
+	r.sendResponse(&HttpResponse{
+		Status:  http.StatusServiceUnavailable,
+		Verdict: "unavailable",
+	})
+}
+
 func (r *RequestContext) SendBadRequest() {
 	r.sendResponse(&HttpResponse{
 		Status:  http.StatusBadRequest,
@@ -45,6 +52,13 @@ func (r *RequestContext) SendBadRequest() {
 	})
 }
 
+func (r *RequestContext) SendNotFound() {
+	r.sendResponse(&HttpResponse{
+		Status:  http.StatusNotFound,
+		Verdict: "not_found",
+	})
+}
+
 func (r *RequestContext) sendResponse(resp *HttpResponse) {
 	r.Writer.Header().Set("Content-Type", "application/json")
 	r.Writer.WriteHeader(resp.Status)
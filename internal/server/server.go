@@ -26,6 +26,12 @@ func NewServer(h IHandler) *Server {
 		TrackUserAction(h, "get_movies"),
 	))
 
+	mux.Handle("/movies/{id}", newRouteHandler(
+		h.GetMovie,
+		TraceRequest("GET", "/movies/{id}"),
+		TrackUserAction(h, "get_movie"),
+	))
+
 	mux.Handle("/movies/{id}/ratings/{score}", newRouteHandler(
 		h.RateMovie,
 		TraceRequest("GET", "/movies/{id}/ratings/{score}"),
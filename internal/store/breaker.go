@@ -0,0 +1,92 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/vncats/otel-demo/pkg/circuitbreaker"
+	"gorm.io/gorm"
+)
+
+// BreakerStore fails fast with circuitbreaker.ErrOpen while the database keeps failing.
+type BreakerStore struct {
+	store   IStore
+	breaker *circuitbreaker.Breaker
+}
+
+var _ IStore = (*BreakerStore)(nil)
+
+// IsBreakerFailure reports whether err means that the database is failing, as opposed
+// to a missing record. It is meant for circuitbreaker.Options.IsFailure.
+func IsBreakerFailure(err error) bool {
+	return circuitbreaker.DefaultIsFailure(err) && !errors.Is(err, gorm.ErrRecordNotFound)
+}
+
+func NewBreakerStore(st IStore, breaker *circuitbreaker.Breaker) *BreakerStore {
+	return &BreakerStore{store: st, breaker: breaker}
+}
+
+func (s *BreakerStore) CreateUserAction(ctx context.Context, act *UserAction) error {
+	return s.breaker.Execute(ctx, func(ctx context.Context) error {
+		return s.store.CreateUserAction(ctx, act)
+	})
+}
+
+func (s *BreakerStore) CreateRating(ctx context.Context, rating *Rating, outbox ...*OutboxMessage) error {
+	return s.breaker.Execute(ctx, func(ctx context.Context) error {
+		return s.store.CreateRating(ctx, rating, outbox...)
+	})
+}
+
+func (s *BreakerStore) GetRatingsByMovie(ctx context.Context, movieID int) ([]*Rating, error) {
+	return circuitbreaker.Do(ctx, s.breaker, func(ctx context.Context) ([]*Rating, error) {
+		return s.store.GetRatingsByMovie(ctx, movieID)
+	})
+}
+
+func (s *BreakerStore) GetRatingCounts(ctx context.Context, movieID int) ([]*RatingCount, error) {
+	return circuitbreaker.Do(ctx, s.breaker, func(ctx context.Context) ([]*RatingCount, error) {
+		return s.store.GetRatingCounts(ctx, movieID)
+	})
+}
+
+func (s *BreakerStore) UpdateStats(ctx context.Context, movieID int, stats *Stats) error {
+	return s.breaker.Execute(ctx, func(ctx context.Context) error {
+		return s.store.UpdateStats(ctx, movieID, stats)
+	})
+}
+
+func (s *BreakerStore) GetMovies(ctx context.Context) ([]*Movie, error) {
+	return circuitbreaker.Do(ctx, s.breaker, s.store.GetMovies)
+}
+
+func (s *BreakerStore) GetMovie(ctx context.Context, id int) (*Movie, error) {
+	return circuitbreaker.Do(ctx, s.breaker, func(ctx context.Context) (*Movie, error) {
+		return s.store.GetMovie(ctx, id)
+	})
+}
+
+func (s *BreakerStore) ClaimPendingOutbox(ctx context.Context, limit int, lease time.Duration) ([]*OutboxMessage, error) {
+	return circuitbreaker.Do(ctx, s.breaker, func(ctx context.Context) ([]*OutboxMessage, error) {
+		return s.store.ClaimPendingOutbox(ctx, limit, lease)
+	})
+}
+
+func (s *BreakerStore) PurgeSentOutbox(ctx context.Context, before time.Time) error {
+	return s.breaker.Execute(ctx, func(ctx context.Context) error {
+		return s.store.PurgeSentOutbox(ctx, before)
+	})
+}
+
+func (s *BreakerStore) MarkOutboxSent(ctx context.Context, id int) error {
+	return s.breaker.Execute(ctx, func(ctx context.Context) error {
+		return s.store.MarkOutboxSent(ctx, id)
+	})
+}
+
+func (s *BreakerStore) MarkOutboxFailed(ctx context.Context, id int, cause error, nextAttempt time.Time) error {
+	return s.breaker.Execute(ctx, func(ctx context.Context) error {
+		return s.store.MarkOutboxFailed(ctx, id, cause, nextAttempt)
+	})
+}
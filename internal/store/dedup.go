@@ -0,0 +1,119 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/vncats/otel-demo/pkg/kafka"
+	"github.com/vncats/otel-demo/pkg/otel/log"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const dedupPurgeInterval = time.Hour
+
+// ProcessedMessage records a message claimed by a consumer, or processed successfully,
+// until it expires.
+type ProcessedMessage struct {
+	ID        string    `gorm:"primaryKey;size:255"`
+	Processed bool      `gorm:"not null;default:false"`
+	ExpiresAt time.Time `gorm:"index"`
+}
+
+// DedupStore is a kafka.DedupStore keeping the IDs of processed messages in MySQL.
+// Expired rows are ignored, and deleted periodically once started.
+type DedupStore struct {
+	store *Store
+
+	wg     sync.WaitGroup
+	cancel context.CancelFunc
+}
+
+var _ kafka.DedupStore = (*DedupStore)(nil)
+
+// DedupStore returns a DedupStore using the database of s.
+func (s *Store) DedupStore() *DedupStore {
+	return &DedupStore{store: s}
+}
+
+// PurgeProcessedMessages deletes the processed messages which expired.
+func (s *Store) PurgeProcessedMessages(ctx context.Context) error {
+	return s.db.WithContext(ctx).Where("expires_at <= ?", time.Now()).Delete(&ProcessedMessage{}).Error
+}
+
+// Start purges the expired messages every hour until Stop is called.
+func (s *DedupStore) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	s.wg.Add(1)
+
+	log.Info(ctx, "Starting processed message purge")
+	go func() {
+		defer s.wg.Done()
+
+		ticker := time.NewTicker(dedupPurgeInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := s.store.PurgeProcessedMessages(ctx); err != nil {
+					log.Error(ctx, "failed to purge processed messages", "error", err)
+				}
+			}
+		}
+	}()
+}
+
+func (s *DedupStore) Stop() {
+	log.Info(context.Background(), "Stopping processed message purge")
+	s.cancel()
+	s.wg.Wait()
+}
+
+func (s *DedupStore) Claim(ctx context.Context, id string, ttl time.Duration) (bool, bool, error) {
+	db := s.store.db.WithContext(ctx)
+
+	// an expired row is dropped first, as if it were purged; a live one is left alone, so
+	// that only one of the concurrent inserts below succeeds
+	now := time.Now()
+	if err := db.Where("id = ? AND expires_at <= ?", id, now).Delete(&ProcessedMessage{}).Error; err != nil {
+		return false, false, err
+	}
+
+	res := db.Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&ProcessedMessage{ID: id, ExpiresAt: now.Add(ttl)})
+	if res.Error != nil {
+		return false, false, res.Error
+	}
+	if res.RowsAffected > 0 {
+		return true, false, nil
+	}
+
+	var msg ProcessedMessage
+	err := db.Take(&msg, "id = ?", id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		// released meanwhile, so the message is retried as if in progress
+		return false, false, nil
+	}
+	if err != nil {
+		return false, false, err
+	}
+
+	return false, msg.Processed, nil
+}
+
+func (s *DedupStore) Complete(ctx context.Context, id string, ttl time.Duration) error {
+	msg := &ProcessedMessage{ID: id, Processed: true, ExpiresAt: time.Now().Add(ttl)}
+	return s.store.db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"processed", "expires_at"}),
+	}).Create(msg).Error
+}
+
+func (s *DedupStore) Release(ctx context.Context, id string) error {
+	return s.store.db.WithContext(ctx).Delete(&ProcessedMessage{ID: id}).Error
+}
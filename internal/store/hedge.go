@@ -0,0 +1,53 @@
+package store
+
+import (
+	"context"
+	"errors"
+
+	"github.com/vncats/otel-demo/pkg/retry"
+	"gorm.io/gorm"
+)
+
+// HedgedStore hedges the idempotent reads of a store, so that a slow query is overtaken
+// by a second one instead of delaying the request. Writes are passed through.
+type HedgedStore struct {
+	IStore
+	cfg retry.HedgeConfig
+}
+
+func NewHedgedStore(st IStore, cfg retry.HedgeConfig) *HedgedStore {
+	return &HedgedStore{IStore: st, cfg: cfg}
+}
+
+func (s *HedgedStore) GetMovies(ctx context.Context) ([]*Movie, error) {
+	return retry.Hedge(ctx, s.config("GetMovies"), s.IStore.GetMovies)
+}
+
+func (s *HedgedStore) GetMovie(ctx context.Context, id int) (*Movie, error) {
+	return retry.Hedge(ctx, s.config("GetMovie"), func(ctx context.Context) (*Movie, error) {
+		movie, err := s.IStore.GetMovie(ctx, id)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			// asking again does not make the movie exist
+			return nil, retry.Permanent(err)
+		}
+		return movie, err
+	})
+}
+
+func (s *HedgedStore) GetRatingsByMovie(ctx context.Context, movieID int) ([]*Rating, error) {
+	return retry.Hedge(ctx, s.config("GetRatingsByMovie"), func(ctx context.Context) ([]*Rating, error) {
+		return s.IStore.GetRatingsByMovie(ctx, movieID)
+	})
+}
+
+func (s *HedgedStore) GetRatingCounts(ctx context.Context, movieID int) ([]*RatingCount, error) {
+	return retry.Hedge(ctx, s.config("GetRatingCounts"), func(ctx context.Context) ([]*RatingCount, error) {
+		return s.IStore.GetRatingCounts(ctx, movieID)
+	})
+}
+
+func (s *HedgedStore) config(name string) retry.HedgeConfig {
+	cfg := s.cfg
+	cfg.Name = name
+	return cfg
+}
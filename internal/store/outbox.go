@@ -0,0 +1,128 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/vncats/otel-demo/pkg/prim"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// OutboxMessage is a message waiting to be published to Kafka. It is written in the same
+// transaction as the change it describes, so that the message is published if and only
+// if the change is committed.
+type OutboxMessage struct {
+	ID           int        `json:"id"`
+	Topic        string     `json:"topic"`
+	Key          string     `json:"key"`
+	Payload      []byte     `json:"payload"`
+	TraceContext prim.Map   `json:"trace_context"`
+	Attempts     int        `json:"attempts"`
+	LastError    string     `json:"last_error"`
+	NextAttempt  time.Time  `json:"next_attempt" gorm:"index"`
+	SentAt       *time.Time `json:"sent_at" gorm:"index"`
+	CreatedAt    time.Time  `json:"created_at"`
+
+	// Value is encoded into Payload when the message is created, which allows it to
+	// refer to rows created earlier in the same transaction.
+	Value any `json:"-" gorm:"-"`
+}
+
+// NewOutboxMessage creates a message carrying the trace context of ctx, so that its
+// publication is part of the trace of the request which caused it.
+func NewOutboxMessage(ctx context.Context, topic string, key string, value any) *OutboxMessage {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+
+	traceContext := make(prim.Map, len(carrier))
+	for k, v := range carrier {
+		traceContext[k] = v
+	}
+
+	return &OutboxMessage{
+		Topic:        topic,
+		Key:          key,
+		TraceContext: traceContext,
+		Value:        value,
+		NextAttempt:  time.Now(),
+	}
+}
+
+func (m *OutboxMessage) BeforeCreate(_ *gorm.DB) error {
+	if m.Value == nil {
+		return nil
+	}
+
+	payload, err := json.Marshal(m.Value)
+	if err != nil {
+		return err
+	}
+	m.Payload = payload
+
+	return nil
+}
+
+// Context returns ctx with the trace context the message was created with.
+func (m *OutboxMessage) Context(ctx context.Context) context.Context {
+	carrier := propagation.MapCarrier{}
+	for k := range m.TraceContext {
+		carrier[k] = m.TraceContext.String(k)
+	}
+
+	return otel.GetTextMapPropagator().Extract(ctx, carrier)
+}
+
+// ClaimPendingOutbox returns up to limit messages due for publication and leases them
+// for the given duration, so that concurrent relays skip them meanwhile. A message whose
+// relay dies before marking it is claimed again once its lease expires.
+func (s *Store) ClaimPendingOutbox(ctx context.Context, limit int, lease time.Duration) ([]*OutboxMessage, error) {
+	var msgs []*OutboxMessage
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("sent_at IS NULL AND next_attempt <= ?", now).
+			Order("id").
+			Limit(limit).
+			Find(&msgs).Error
+		if err != nil || len(msgs) == 0 {
+			return err
+		}
+
+		ids := make([]int, len(msgs))
+		for i, msg := range msgs {
+			ids[i] = msg.ID
+		}
+
+		return tx.Model(&OutboxMessage{}).Where("id IN ?", ids).
+			Update("next_attempt", now.Add(lease)).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return msgs, nil
+}
+
+// PurgeSentOutbox deletes the messages sent before the given time.
+func (s *Store) PurgeSentOutbox(ctx context.Context, before time.Time) error {
+	return s.db.WithContext(ctx).Where("sent_at < ?", before).Delete(&OutboxMessage{}).Error
+}
+
+func (s *Store) MarkOutboxSent(ctx context.Context, id int) error {
+	return s.db.WithContext(ctx).Model(&OutboxMessage{ID: id}).Updates(map[string]interface{}{
+		"sent_at":  time.Now(),
+		"attempts": gorm.Expr("attempts + 1"),
+	}).Error
+}
+
+func (s *Store) MarkOutboxFailed(ctx context.Context, id int, cause error, nextAttempt time.Time) error {
+	return s.db.WithContext(ctx).Model(&OutboxMessage{ID: id}).Updates(map[string]interface{}{
+		"last_error":   cause.Error(),
+		"next_attempt": nextAttempt,
+		"attempts":     gorm.Expr("attempts + 1"),
+	}).Error
+}
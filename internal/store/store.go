@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"time"
 
 	"gorm.io/plugin/opentelemetry/tracing"
 
@@ -63,11 +64,16 @@ type RatingCount struct {
 
 type IStore interface {
 	CreateUserAction(ctx context.Context, act *UserAction) error
-	CreateRating(ctx context.Context, rating *Rating) error
+	CreateRating(ctx context.Context, rating *Rating, outbox ...*OutboxMessage) error
 	GetRatingsByMovie(ctx context.Context, movieID int) ([]*Rating, error)
 	GetRatingCounts(ctx context.Context, movieID int) ([]*RatingCount, error)
 	UpdateStats(ctx context.Context, movieID int, stats *Stats) error
 	GetMovies(ctx context.Context) ([]*Movie, error)
+	GetMovie(ctx context.Context, id int) (*Movie, error)
+	ClaimPendingOutbox(ctx context.Context, limit int, lease time.Duration) ([]*OutboxMessage, error)
+	PurgeSentOutbox(ctx context.Context, before time.Time) error
+	MarkOutboxSent(ctx context.Context, id int) error
+	MarkOutboxFailed(ctx context.Context, id int, cause error, nextAttempt time.Time) error
 }
 
 var _ IStore = (*Store)(nil)
@@ -107,12 +113,23 @@ func (s *Store) UpdateStats(ctx context.Context, movieID int, stats *Stats) erro
 	return nil
 }
 
-func (s *Store) CreateRating(ctx context.Context, rating *Rating) error {
+// CreateRating upserts rating and creates the outbox messages announcing it in the same transaction.
+func (s *Store) CreateRating(ctx context.Context, rating *Rating, outbox ...*OutboxMessage) error {
 	rating.Key = fmt.Sprintf("%s:%d", rating.UID, rating.MovieID)
-	return s.db.WithContext(ctx).Clauses(clause.OnConflict{
-		Columns:   []clause.Column{{Name: "key"}},
-		DoUpdates: clause.Assignments(map[string]interface{}{"score": rating.Score}),
-	}).Create(rating).Error
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "key"}},
+			DoUpdates: clause.Assignments(map[string]interface{}{"score": rating.Score}),
+		}).Create(rating).Error
+		if err != nil {
+			return err
+		}
+
+		if len(outbox) == 0 {
+			return nil
+		}
+		return tx.Create(outbox).Error
+	})
 }
 
 func (s *Store) GetRatingsByMovie(ctx context.Context, movieID int) ([]*Rating, error) {
@@ -157,8 +174,19 @@ func (s *Store) GetMovies(ctx context.Context) ([]*Movie, error) {
 	return movies, nil
 }
 
+// GetMovie returns the movie with id, or gorm.ErrRecordNotFound if there is none.
+func (s *Store) GetMovie(ctx context.Context, id int) (*Movie, error) {
+	var movie Movie
+	err := s.db.WithContext(ctx).First(&movie, id).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return &movie, nil
+}
+
 func (s *Store) Migrate() error {
-	err := s.db.AutoMigrate(&Movie{}, &Rating{}, &UserAction{})
+	err := s.db.AutoMigrate(&Movie{}, &Rating{}, &UserAction{}, &OutboxMessage{}, &ProcessedMessage{})
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,517 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/vncats/otel-demo/pkg/circuitbreaker"
+	"github.com/vncats/otel-demo/pkg/otel/log"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/singleflight"
+)
+
+// ErrNotFound is returned when the loader reported that a value does not exist. It is
+// cached for Options.NegativeTTL so that missing values do not hit the loader every time.
+var ErrNotFound = errors.New("not found")
+
+const (
+	defaultTTL         = time.Minute
+	defaultStaleTTL    = time.Hour
+	defaultLoadTimeout = 10 * time.Second
+)
+
+// KeyBuilder builds the key of a value from the name of its cache and its identifiers.
+type KeyBuilder func(name string, parts ...any) string
+
+type Options struct {
+	// Name namespaces the keys of the cache.
+	Name string
+	// TTL is how long a loaded value is cached, one minute by default.
+	TTL time.Duration
+	// NegativeTTL is how long ErrNotFound is cached. Zero disables negative caching.
+	NegativeTTL time.Duration
+	// EarlyRefresh is the beta of the probabilistic early expiration: the higher it is,
+	// the earlier a value is reloaded in the background before it expires, in proportion
+	// to how long it took to load. 1 is a sensible value and zero disables it.
+	EarlyRefresh float64
+	// KeyBuilder defaults to joining the name and parts with colons.
+	KeyBuilder KeyBuilder
+	// IsNotFound reports whether a loader error means the value does not exist. It
+	// defaults to matching ErrNotFound.
+	IsNotFound func(err error) bool
+	// LoadTimeout bounds a load, 10 seconds by default. A load is shared by the concurrent
+	// misses of a key, so it does not stop when the caller which started it gives up.
+	LoadTimeout time.Duration
+	// Invalidator, when set, stops a load in flight from caching its value if the key is
+	// invalidated meanwhile, since the value may have been read before the change. It also
+	// keeps the in-process tiers of every instance coherent with Redis.
+	Invalidator *Invalidator
+
+	// MemorySize is the number of values kept in process in front of Redis. Zero disables
+	// the in-process tier.
+	MemorySize int
+	// MemoryTTL bounds how long a value is kept in process, TTL by default. Without an
+	// Invalidator, it is how long an instance may serve a value changed by another one.
+	MemoryTTL time.Duration
+
+	// FailOpen treats Redis errors as misses, loading values from the source of truth
+	// instead of failing.
+	FailOpen bool
+	// Breaker, when set, stops calling Redis while it keeps failing. Only Redis calls go
+	// through it, so failures of the loader do not open it.
+	Breaker *circuitbreaker.Breaker
+	// StaleSize is the number of last good values kept in process, to be served when
+	// loading fails after a miss. Zero disables serving stale values.
+	StaleSize int
+	// StaleTTL bounds how stale a served value may be, one hour by default.
+	StaleTTL time.Duration
+
+	// Codec encodes the values stored in Redis, JSONCodec by default. Values written with
+	// another built-in codec are still decoded, and values which cannot be decoded are
+	// misses, so changing the codec does not require flushing the cache.
+	Codec Codec
+	// Compression compresses the encoded values larger than CompressThreshold, 1 KiB by
+	// default.
+	Compression       Compression
+	CompressThreshold int
+}
+
+// Cache is a read-through and write-through cache of values of type T in Redis, with an
+// optional in-process tier in front of it. Concurrent loads of the same key are coalesced
+// into one.
+type Cache[T any] struct {
+	client       redis.UniversalClient
+	name         string
+	ttl          time.Duration
+	negativeTTL  time.Duration
+	earlyRefresh float64
+	keyBuilder   KeyBuilder
+	isNotFound   func(err error) bool
+	loadTimeout  time.Duration
+	memory       *memory[T]
+	failOpen     bool
+	breaker      *circuitbreaker.Breaker
+	stale        *memory[T]
+	invalidator  *Invalidator
+	format       *format
+	metrics      *metrics
+
+	group singleflight.Group
+
+	mu sync.Mutex
+	// loading holds the keys being loaded, mapped to whether they were invalidated since.
+	loading map[string]bool
+}
+
+// entry is the cached representation of a value, along with what is needed to refresh
+// it early.
+type entry[T any] struct {
+	Value    T     `json:"v" msgpack:"v"`
+	NotFound bool  `json:"n,omitempty" msgpack:"n,omitempty"`
+	Delta    int64 `json:"d" msgpack:"d"`
+	Expiry   int64 `json:"e" msgpack:"e"`
+}
+
+func New[T any](client redis.UniversalClient, opts Options) (*Cache[T], error) {
+	if opts.TTL <= 0 {
+		opts.TTL = defaultTTL
+	}
+
+	if opts.KeyBuilder == nil {
+		opts.KeyBuilder = JoinKey
+	}
+
+	if opts.IsNotFound == nil {
+		opts.IsNotFound = isErrNotFound
+	}
+
+	if opts.LoadTimeout <= 0 {
+		opts.LoadTimeout = defaultLoadTimeout
+	}
+
+	if opts.MemoryTTL <= 0 {
+		opts.MemoryTTL = opts.TTL
+	}
+
+	if opts.StaleTTL <= 0 {
+		opts.StaleTTL = defaultStaleTTL
+	}
+
+	if opts.Codec == nil {
+		opts.Codec = JSONCodec{}
+	}
+
+	if opts.CompressThreshold <= 0 {
+		opts.CompressThreshold = defaultCompressThreshold
+	}
+
+	m, err := newMetrics(opts.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Cache[T]{
+		client:       client,
+		name:         opts.Name,
+		ttl:          opts.TTL,
+		negativeTTL:  opts.NegativeTTL,
+		earlyRefresh: opts.EarlyRefresh,
+		keyBuilder:   opts.KeyBuilder,
+		isNotFound:   opts.IsNotFound,
+		loadTimeout:  opts.LoadTimeout,
+		memory:       newMemory[T](opts.MemorySize, opts.MemoryTTL, true),
+		failOpen:     opts.FailOpen,
+		breaker:      opts.Breaker,
+		stale:        newMemory[T](opts.StaleSize, opts.StaleTTL, false),
+		invalidator:  opts.Invalidator,
+		format: &format{
+			codec:       opts.Codec,
+			compression: opts.Compression,
+			threshold:   opts.CompressThreshold,
+		},
+		metrics: m,
+		loading: make(map[string]bool),
+	}
+	if opts.Invalidator != nil {
+		opts.Invalidator.OnInvalidate(c.invalidated)
+	}
+
+	return c, nil
+}
+
+// JoinKey joins name and parts with colons.
+func JoinKey(name string, parts ...any) string {
+	var sb strings.Builder
+	sb.WriteString(name)
+	for _, part := range parts {
+		sb.WriteByte(':')
+		sb.WriteString(fmt.Sprint(part))
+	}
+	return sb.String()
+}
+
+// Key builds the key of the value identified by parts.
+func (c *Cache[T]) Key(parts ...any) string {
+	return c.keyBuilder(c.name, parts...)
+}
+
+// Get returns the value cached at key, loading and caching it with load on a miss. The
+// span in ctx records whether the value was served from the cache.
+//
+// With FailOpen, a Redis error, or the breaker being open, counts as a miss. With StaleSize, the last good value of
+// key is returned if loading it fails.
+func (c *Cache[T]) Get(ctx context.Context, key string, load func(ctx context.Context) (T, error)) (T, error) {
+	startTime := time.Now()
+	e, tier, err := c.lookup(ctx, key)
+	if err != nil {
+		if !c.failOpen {
+			var zero T
+			return zero, err
+		}
+		c.degrade(ctx, degradationFailOpen, key, err)
+	}
+
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(nameKey.String(c.name), hitKey.Bool(e != nil))
+	if e != nil {
+		span.SetAttributes(tierKey.String(tier))
+		defer c.metrics.recordDuration(ctx, startTime, true)
+		return c.hit(ctx, key, e, load)
+	}
+
+	defer c.metrics.recordDuration(ctx, startTime, false)
+	value, err := c.load(ctx, key, load)
+	if err == nil || errors.Is(err, ErrNotFound) || c.isNotFound(err) || ctx.Err() != nil {
+		return value, err
+	}
+
+	if e, _, ok := c.stale.get(key); ok {
+		c.degrade(ctx, degradationServeStale, key, err)
+		return e.result()
+	}
+
+	return value, err
+}
+
+// lookup returns the entry at key and the tier which had it, or a nil entry on a miss.
+func (c *Cache[T]) lookup(ctx context.Context, key string) (*entry[T], string, error) {
+	if c.memory != nil {
+		e, reason, ok := c.memory.get(key)
+		if ok {
+			c.metrics.recordHit(ctx, TierMemory)
+			return e, TierMemory, nil
+		}
+		c.metrics.recordMiss(ctx, TierMemory)
+		if reason != "" {
+			c.metrics.recordEvictions(ctx, reason, 1)
+		}
+	}
+
+	e, err := c.read(ctx, key)
+	if errors.Is(err, redis.Nil) {
+		c.metrics.recordMiss(ctx, TierRedis)
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	c.metrics.recordHit(ctx, TierRedis)
+	c.remember(ctx, key, e)
+	return e, TierRedis, nil
+}
+
+// Set caches value at key, typically after writing it to the source of truth. Only the
+// in-process tier of this instance is updated, so other instances keep serving their own
+// until it expires or the key is invalidated.
+func (c *Cache[T]) Set(ctx context.Context, key string, value T) error {
+	e := &entry[T]{Value: value}
+	if err := c.write(ctx, key, e, c.ttl); err != nil {
+		return err
+	}
+	c.remember(ctx, key, e)
+
+	return nil
+}
+
+// Delete evicts the values cached at keys, from Redis and from the in-process tier of
+// this instance, and of every other instance through the Invalidator if any. Values being
+// loaded meanwhile are not cached.
+func (c *Cache[T]) Delete(ctx context.Context, keys ...string) error {
+	var err error
+	if c.invalidator != nil {
+		err = c.invalidator.Invalidate(ctx, keys...)
+	} else {
+		c.invalidated(ctx, keys)
+		err = c.redis(ctx, func(ctx context.Context) error {
+			return c.client.Del(ctx, keys...).Err()
+		})
+	}
+	if err != nil {
+		c.metrics.recordError(ctx, operationDelete)
+		return err
+	}
+
+	return nil
+}
+
+// hit returns the value of e, refreshing it in the background if it is about to expire.
+func (c *Cache[T]) hit(ctx context.Context, key string, e *entry[T], load func(ctx context.Context) (T, error)) (T, error) {
+	if c.shouldRefresh(e) {
+		go c.refresh(context.WithoutCancel(ctx), key, load)
+	}
+	return e.result()
+}
+
+// remember keeps e in the in-process tier, and as the last good value of key.
+func (c *Cache[T]) remember(ctx context.Context, key string, e *entry[T]) {
+	c.metrics.recordEvictions(ctx, evictionSize, c.memory.add(key, e))
+	c.stale.add(key, e)
+}
+
+// degrade records that the value of key is served in a degraded mode because of err.
+func (c *Cache[T]) degrade(ctx context.Context, degradation string, key string, err error) {
+	log.Warn(ctx, "cache degraded", "error", err, "cache", c.name, "key", key, "degradation", degradation)
+	trace.SpanFromContext(ctx).AddEvent(degradedEventName, trace.WithAttributes(
+		nameKey.String(c.name),
+		degradationKey.String(degradation),
+		semconv.ExceptionType(fmt.Sprintf("%T", err)),
+		semconv.ExceptionMessage(err.Error()),
+	))
+	c.metrics.recordDegraded(ctx, degradation)
+}
+
+// load calls load once for all the concurrent misses of key and caches its result. Every
+// caller stops waiting when its own ctx is done, while the load goes on for the others.
+func (c *Cache[T]) load(ctx context.Context, key string, load func(ctx context.Context) (T, error)) (T, error) {
+	var zero T
+	select {
+	case <-ctx.Done():
+		return zero, ctx.Err()
+	case res := <-c.group.DoChan(key, c.shared(ctx, key, load)):
+		if res.Err != nil {
+			return zero, res.Err
+		}
+		return res.Val.(*entry[T]).result()
+	}
+}
+
+func (c *Cache[T]) refresh(ctx context.Context, key string, load func(ctx context.Context) (T, error)) {
+	_, _, _ = c.group.Do(key, c.shared(ctx, key, load))
+}
+
+// shared returns the load of key shared through the singleflight group, which runs
+// detached from the cancellation of ctx and bounded by the load timeout instead.
+func (c *Cache[T]) shared(ctx context.Context, key string, load func(ctx context.Context) (T, error)) func() (interface{}, error) {
+	return func() (interface{}, error) {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), c.loadTimeout)
+		defer cancel()
+		return c.loadAndWrite(ctx, key, load)
+	}
+}
+
+func (c *Cache[T]) loadAndWrite(ctx context.Context, key string, load func(ctx context.Context) (T, error)) (*entry[T], error) {
+	c.beginLoad(key)
+	startTime := time.Now()
+	value, err := load(ctx)
+	stale := c.endLoad(key)
+	c.metrics.recordFallback(ctx, err)
+
+	e, ttl := &entry[T]{Value: value, Delta: time.Since(startTime).Milliseconds()}, c.ttl
+	if err != nil {
+		if !c.isNotFound(err) || c.negativeTTL <= 0 {
+			return nil, err
+		}
+		e, ttl = &entry[T]{NotFound: true}, c.negativeTTL
+	}
+
+	if stale {
+		log.Info(ctx, "skipped caching a value invalidated while loading", "key", key)
+		return e, nil
+	}
+	if err := c.write(ctx, key, e, ttl); err != nil {
+		// the loaded value is still valid
+		log.Error(ctx, "failed to write cache", "error", err, "key", key)
+	}
+	c.remember(ctx, key, e)
+
+	return e, nil
+}
+
+func (c *Cache[T]) beginLoad(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.loading[key] = false
+}
+
+// endLoad reports whether key was invalidated since beginLoad.
+func (c *Cache[T]) endLoad(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stale := c.loading[key]
+	delete(c.loading, key)
+	return stale
+}
+
+func (c *Cache[T]) invalidated(ctx context.Context, keys []string) {
+	c.metrics.recordEvictions(ctx, evictionInvalidated, c.memory.delete(keys...))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, key := range keys {
+		if _, ok := c.loading[key]; ok {
+			c.loading[key] = true
+		}
+	}
+}
+
+// read returns the entry at key, or redis.Nil if there is none or it cannot be decoded,
+// so that it is overwritten.
+func (c *Cache[T]) read(ctx context.Context, key string) (*entry[T], error) {
+	var data []byte
+	err := c.redis(ctx, func(ctx context.Context) error {
+		var err error
+		data, err = c.client.Get(ctx, key).Bytes()
+		return err
+	})
+	if errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+	if err != nil {
+		c.metrics.recordError(ctx, operationRead)
+		return nil, err
+	}
+	c.metrics.recordSize(ctx, operationRead, len(data))
+
+	var e entry[T]
+	if err := c.format.unmarshal(data, &e); err != nil {
+		if !errors.Is(err, errUnknownFormat) {
+			c.metrics.recordError(ctx, operationDecode)
+		}
+		log.Warn(ctx, "failed to decode cache entry", "error", err, "key", key)
+		return nil, redis.Nil
+	}
+
+	return &e, nil
+}
+
+func (c *Cache[T]) write(ctx context.Context, key string, e *entry[T], ttl time.Duration) error {
+	e.Expiry = time.Now().Add(ttl).UnixMilli()
+
+	data, err := c.format.marshal(e)
+	if err != nil {
+		c.metrics.recordError(ctx, operationEncode)
+		return err
+	}
+
+	err = c.redis(ctx, func(ctx context.Context) error {
+		return c.client.Set(ctx, key, data, ttl).Err()
+	})
+	if err != nil {
+		c.metrics.recordError(ctx, operationWrite)
+		return err
+	}
+	c.metrics.recordSize(ctx, operationWrite, len(data))
+
+	return nil
+}
+
+// redis calls fn through the breaker, if any. A missing key is not a failure of Redis.
+func (c *Cache[T]) redis(ctx context.Context, fn func(ctx context.Context) error) error {
+	return callRedis(ctx, c.breaker, fn)
+}
+
+func callRedis(ctx context.Context, breaker *circuitbreaker.Breaker, fn func(ctx context.Context) error) error {
+	if breaker == nil {
+		return fn(ctx)
+	}
+
+	var missing bool
+	err := breaker.Execute(ctx, func(ctx context.Context) error {
+		err := fn(ctx)
+		if errors.Is(err, redis.Nil) {
+			missing = true
+			return nil
+		}
+		return err
+	})
+	if missing {
+		return redis.Nil
+	}
+
+	return err
+}
+
+// shouldRefresh implements the probabilistic early expiration of XFetch: a value is
+// refreshed once now - delta * beta * ln(rand) reaches its expiry.
+func (c *Cache[T]) shouldRefresh(e *entry[T]) bool {
+	if c.earlyRefresh <= 0 || e.NotFound || e.Delta <= 0 {
+		return false
+	}
+
+	gap := float64(e.Delta) * c.earlyRefresh * -math.Log(1-rand.Float64())
+	return time.Now().UnixMilli()+int64(gap) >= e.Expiry
+}
+
+func (e *entry[T]) result() (T, error) {
+	if e.NotFound {
+		var zero T
+		return zero, ErrNotFound
+	}
+	return e.Value, nil
+}
+
+func isErrNotFound(err error) bool {
+	return errors.Is(err, ErrNotFound)
+}
@@ -0,0 +1,237 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/require"
+	"github.com/vncats/otel-demo/pkg/circuitbreaker"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestJoinKey(t *testing.T) {
+	require.Equal(t, "movies", JoinKey("movies"))
+	require.Equal(t, "movie:42:en", JoinKey("movie", 42, "en"))
+
+	c, err := New[int](nil, Options{Name: "movie"})
+	require.NoError(t, err)
+	require.Equal(t, "movie:42", c.Key(42))
+}
+
+func TestShouldRefresh(t *testing.T) {
+	c, err := New[int](nil, Options{EarlyRefresh: 1})
+	require.NoError(t, err)
+
+	fresh := &entry[int]{Delta: 10, Expiry: time.Now().Add(time.Hour).UnixMilli()}
+	require.False(t, c.shouldRefresh(fresh))
+
+	expiring := &entry[int]{Delta: 10, Expiry: time.Now().UnixMilli()}
+	require.True(t, c.shouldRefresh(expiring))
+
+	notFound := &entry[int]{NotFound: true, Delta: 10, Expiry: time.Now().UnixMilli()}
+	require.False(t, c.shouldRefresh(notFound))
+
+	disabled, err := New[int](nil, Options{})
+	require.NoError(t, err)
+	require.False(t, disabled.shouldRefresh(expiring))
+}
+
+func TestEntryResult(t *testing.T) {
+	v, err := (&entry[int]{Value: 7}).result()
+	require.NoError(t, err)
+	require.Equal(t, 7, v)
+
+	_, err = (&entry[int]{NotFound: true}).result()
+	require.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestInvalidatedWhileLoading(t *testing.T) {
+	c, err := New[int](nil, Options{MemorySize: 10})
+	require.NoError(t, err)
+
+	c.remember(context.Background(), "a", &entry[int]{Value: 1})
+	c.beginLoad("a")
+	c.invalidated(context.Background(), []string{"a", "b"})
+	require.True(t, c.endLoad("a"))
+	_, _, ok := c.memory.get("a")
+	require.False(t, ok)
+
+	// invalidating a key which is not loading is a no-op
+	c.beginLoad("b")
+	require.False(t, c.endLoad("b"))
+	require.Empty(t, c.loading)
+}
+
+func TestDeleteInvalidatesLocally(t *testing.T) {
+	client := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1})
+	defer client.Close()
+	ctx := context.Background()
+
+	inv := NewInvalidator(client, InvalidatorOptions{})
+	var calls int
+	inv.OnInvalidate(func(context.Context, []string) { calls++ })
+	c, err := New[int](client, Options{MemorySize: 10, Invalidator: inv})
+	require.NoError(t, err)
+
+	// this instance is invalidated even though Redis is down
+	c.remember(ctx, "a", &entry[int]{Value: 1})
+	c.beginLoad("a")
+	require.Error(t, c.Delete(ctx, "a"))
+	require.True(t, c.endLoad("a"))
+	_, _, ok := c.memory.get("a")
+	require.False(t, ok)
+	require.Equal(t, 1, calls)
+
+	// the echo of its own invalidation is skipped, unlike those of other instances
+	inv.handle(&redis.Message{Payload: `{"keys":["a"],"origin":"` + inv.id + `"}`})
+	require.Equal(t, 1, calls)
+	inv.handle(&redis.Message{Payload: `{"keys":["a"],"origin":"other"}`})
+	require.Equal(t, 2, calls)
+}
+
+func TestMemory(t *testing.T) {
+	m := newMemory[int](2, time.Hour, true)
+
+	require.Zero(t, m.add("a", &entry[int]{Value: 1}))
+	require.Zero(t, m.add("b", &entry[int]{Value: 2}))
+	_, _, ok := m.get("a")
+	require.True(t, ok)
+
+	// b is the least recently used
+	require.Equal(t, 1, m.add("c", &entry[int]{Value: 3}))
+	_, _, ok = m.get("b")
+	require.False(t, ok)
+
+	// an entry expires with its Redis expiry when it comes first
+	m.add("d", &entry[int]{Value: 4, Expiry: time.Now().Add(-time.Second).UnixMilli()})
+	_, reason, ok := m.get("d")
+	require.False(t, ok)
+	require.Equal(t, evictionExpired, reason)
+
+	require.Equal(t, 1, m.delete("c", "missing"))
+
+	var disabled *memory[int]
+	require.Nil(t, newMemory[int](0, time.Hour, true))
+	require.Zero(t, disabled.add("a", &entry[int]{}))
+	_, _, ok = disabled.get("a")
+	require.False(t, ok)
+}
+
+func TestGetRecordsHit(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test")
+
+	c, err := New[int](nil, Options{Name: "numbers", MemorySize: 10})
+	require.NoError(t, err)
+	c.remember(context.Background(), "a", &entry[int]{Value: 1})
+
+	ctx, span := tracer.Start(context.Background(), "op")
+	v, err := c.Get(ctx, "a", func(context.Context) (int, error) {
+		t.Fatal("a cached value must not be loaded")
+		return 0, nil
+	})
+	span.End()
+	require.NoError(t, err)
+	require.Equal(t, 1, v)
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 1)
+	require.ElementsMatch(t, []attribute.KeyValue{
+		nameKey.String("numbers"),
+		hitKey.Bool(true),
+		tierKey.String(TierMemory),
+	}, spans[0].Attributes())
+}
+
+func TestDegradedModes(t *testing.T) {
+	// nothing listens there, so every Redis operation fails
+	client := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1})
+	defer client.Close()
+	ctx := context.Background()
+	errDown := errors.New("database is down")
+
+	strict, err := New[int](client, Options{})
+	require.NoError(t, err)
+	_, err = strict.Get(ctx, "a", func(context.Context) (int, error) { return 1, nil })
+	require.Error(t, err)
+
+	c, err := New[int](client, Options{FailOpen: true, StaleSize: 10})
+	require.NoError(t, err)
+
+	v, err := c.Get(ctx, "a", func(context.Context) (int, error) { return 1, nil })
+	require.NoError(t, err)
+	require.Equal(t, 1, v)
+
+	v, err = c.Get(ctx, "a", func(context.Context) (int, error) { return 0, errDown })
+	require.NoError(t, err)
+	require.Equal(t, 1, v)
+
+	_, err = c.Get(ctx, "b", func(context.Context) (int, error) { return 0, errDown })
+	require.ErrorIs(t, err, errDown)
+}
+
+func TestBreaker(t *testing.T) {
+	client := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1})
+	defer client.Close()
+	ctx := context.Background()
+
+	breaker, err := circuitbreaker.New(circuitbreaker.Options{Name: "redis", FailureThreshold: 2})
+	require.NoError(t, err)
+	c, err := New[int](client, Options{FailOpen: true, Breaker: breaker})
+	require.NoError(t, err)
+
+	// the failed read and write open the breaker, and the value is still loaded
+	v, err := c.Get(ctx, "a", func(context.Context) (int, error) { return 1, nil })
+	require.NoError(t, err)
+	require.Equal(t, 1, v)
+	require.Equal(t, circuitbreaker.StateOpen, breaker.State())
+
+	v, err = c.Get(ctx, "a", func(context.Context) (int, error) { return 2, nil })
+	require.NoError(t, err)
+	require.Equal(t, 2, v)
+	require.ErrorIs(t, c.Delete(ctx, "a"), circuitbreaker.ErrOpen)
+}
+
+func TestLoadOutlivesCaller(t *testing.T) {
+	client := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1})
+	defer client.Close()
+
+	c, err := New[int](client, Options{FailOpen: true})
+	require.NoError(t, err)
+
+	started, release := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	load := func(ctx context.Context) (int, error) {
+		once.Do(func() { close(started) })
+		<-release
+		return 1, ctx.Err()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error)
+	go func() {
+		_, err := c.Get(ctx, "a", load)
+		errs <- err
+	}()
+	<-started
+
+	values := make(chan int)
+	go func() {
+		v, err := c.Get(context.Background(), "a", load)
+		errs <- err
+		values <- v
+	}()
+
+	// the caller which started the load gives up, while the load goes on for the other
+	cancel()
+	require.ErrorIs(t, <-errs, context.Canceled)
+	close(release)
+	require.NoError(t, <-errs)
+	require.Equal(t, 1, <-values)
+}
@@ -0,0 +1,172 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// formatVersion is the first byte of every value stored in Redis. It changes with the
+// layout of stored values, so that values written in another layout are mere misses.
+const formatVersion byte = 1
+
+const defaultCompressThreshold = 1 << 10
+
+// errUnknownFormat is returned when decoding a value stored in a layout, codec or
+// compression which this instance does not know. Such values are treated as misses.
+var errUnknownFormat = errors.New("unknown cache value format")
+
+// Codec encodes the values of a cache.
+type Codec interface {
+	// ID identifies the codec in stored values. IDs below 16 are reserved.
+	ID() byte
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+// IDs of the built-in codecs.
+const (
+	CodecIDJSON    byte = 1
+	CodecIDMsgpack byte = 2
+	CodecIDGob     byte = 3
+)
+
+// builtinCodecs decode values written with another built-in codec than the configured
+// one, e.g. while rolling out a codec change.
+var builtinCodecs = map[byte]Codec{
+	CodecIDJSON:    JSONCodec{},
+	CodecIDMsgpack: MsgpackCodec{},
+	CodecIDGob:     GobCodec{},
+}
+
+type JSONCodec struct{}
+
+func (JSONCodec) ID() byte { return CodecIDJSON }
+
+func (JSONCodec) Marshal(v any) ([]byte, error) { return json.Marshal(v) }
+
+func (JSONCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+
+type MsgpackCodec struct{}
+
+func (MsgpackCodec) ID() byte { return CodecIDMsgpack }
+
+func (MsgpackCodec) Marshal(v any) ([]byte, error) { return msgpack.Marshal(v) }
+
+func (MsgpackCodec) Unmarshal(data []byte, v any) error { return msgpack.Unmarshal(data, v) }
+
+// GobCodec encodes values with encoding/gob. Concrete types held in interfaces must be
+// registered with gob.Register.
+type GobCodec struct{}
+
+func (GobCodec) ID() byte { return CodecIDGob }
+
+func (GobCodec) Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GobCodec) Unmarshal(data []byte, v any) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// Compression is the algorithm compressing the values larger than a threshold.
+type Compression byte
+
+const (
+	CompressionNone Compression = iota
+	CompressionZstd
+	CompressionSnappy
+)
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionZstd:
+		return "zstd"
+	case CompressionSnappy:
+		return "snappy"
+	default:
+		return fmt.Sprintf("unknown(%d)", byte(c))
+	}
+}
+
+// The zstd encoder and decoder are safe for concurrent EncodeAll and DecodeAll calls.
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+// format encodes values as a header of the format version, codec ID and compression,
+// followed by the encoded value, compressed if it is larger than threshold.
+type format struct {
+	codec       Codec
+	compression Compression
+	threshold   int
+}
+
+func (f *format) marshal(v any) ([]byte, error) {
+	data, err := f.codec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	compression := CompressionNone
+	if len(data) > f.threshold {
+		compression = f.compression
+	}
+
+	header := []byte{formatVersion, f.codec.ID(), byte(compression)}
+	switch compression {
+	case CompressionZstd:
+		return zstdEncoder.EncodeAll(data, header), nil
+	case CompressionSnappy:
+		return append(header, s2.EncodeSnappy(nil, data)...), nil
+	default:
+		return append(header, data...), nil
+	}
+}
+
+func (f *format) unmarshal(data []byte, v any) error {
+	if len(data) < 3 || data[0] != formatVersion {
+		return errUnknownFormat
+	}
+
+	codec := f.codec
+	if data[1] != codec.ID() {
+		var ok bool
+		if codec, ok = builtinCodecs[data[1]]; !ok {
+			return errUnknownFormat
+		}
+	}
+
+	payload, err := decompress(Compression(data[2]), data[3:])
+	if err != nil {
+		return err
+	}
+
+	return codec.Unmarshal(payload, v)
+}
+
+func decompress(compression Compression, data []byte) ([]byte, error) {
+	switch compression {
+	case CompressionNone:
+		return data, nil
+	case CompressionZstd:
+		return zstdDecoder.DecodeAll(data, nil)
+	case CompressionSnappy:
+		return s2.Decode(nil, data)
+	default:
+		return nil, errUnknownFormat
+	}
+}
@@ -0,0 +1,65 @@
+package cache
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type codecValue struct {
+	Name  string
+	Tags  []string
+	Score map[int]int
+}
+
+func TestFormat(t *testing.T) {
+	value := &entry[codecValue]{
+		Value: codecValue{
+			Name:  strings.Repeat("movie", 100),
+			Tags:  []string{"drama", "comedy"},
+			Score: map[int]int{1: 2, 5: 10},
+		},
+		Delta:  10,
+		Expiry: 1000,
+	}
+
+	for _, codec := range []Codec{JSONCodec{}, MsgpackCodec{}, GobCodec{}} {
+		for _, compression := range []Compression{CompressionNone, CompressionZstd, CompressionSnappy} {
+			f := &format{codec: codec, compression: compression, threshold: 64}
+
+			data, err := f.marshal(value)
+			require.NoError(t, err)
+			require.Equal(t, []byte{formatVersion, codec.ID(), byte(compression)}, data[:3])
+
+			var got entry[codecValue]
+			require.NoError(t, f.unmarshal(data, &got))
+			require.Equal(t, value, &got)
+		}
+	}
+}
+
+func TestFormatThreshold(t *testing.T) {
+	f := &format{codec: JSONCodec{}, compression: CompressionZstd, threshold: 1 << 10}
+
+	data, err := f.marshal(&entry[int]{Value: 1})
+	require.NoError(t, err)
+	require.Equal(t, byte(CompressionNone), data[2])
+}
+
+func TestFormatRollout(t *testing.T) {
+	before := &format{codec: JSONCodec{}, threshold: defaultCompressThreshold}
+	after := &format{codec: MsgpackCodec{}, compression: CompressionSnappy, threshold: defaultCompressThreshold}
+
+	// values written with the previous codec are still read
+	data, err := before.marshal(&entry[int]{Value: 1})
+	require.NoError(t, err)
+	var got entry[int]
+	require.NoError(t, after.unmarshal(data, &got))
+	require.Equal(t, 1, got.Value)
+
+	// values without a known header are misses
+	require.ErrorIs(t, after.unmarshal([]byte(`{"v":1}`), &got), errUnknownFormat)
+	require.ErrorIs(t, after.unmarshal([]byte{formatVersion, 99, 0, 1}, &got), errUnknownFormat)
+	require.ErrorIs(t, after.unmarshal([]byte{formatVersion, CodecIDJSON, 99, 1}, &got), errUnknownFormat)
+}
@@ -0,0 +1,166 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"github.com/vncats/otel-demo/pkg/circuitbreaker"
+	"github.com/vncats/otel-demo/pkg/otel/log"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const defaultInvalidationChannel = "cache:invalidations"
+
+var keysKey = attribute.Key("cache.keys")
+
+// InvalidationHandler is called on every instance with the keys which were invalidated.
+type InvalidationHandler func(ctx context.Context, keys []string)
+
+type InvalidatorOptions struct {
+	// Channel is the Redis pub/sub channel of invalidations, "cache:invalidations" by default.
+	Channel string
+	// Breaker, when set, stops invalidating while Redis keeps failing.
+	Breaker *circuitbreaker.Breaker
+}
+
+// Invalidator evicts keys from Redis and broadcasts their eviction to every instance over
+// Redis pub/sub, so that they can drop what they derived from those keys.
+type Invalidator struct {
+	client  redis.UniversalClient
+	id      string
+	channel string
+	breaker *circuitbreaker.Breaker
+
+	mu       sync.RWMutex
+	handlers []InvalidationHandler
+
+	pubsub *redis.PubSub
+	wg     sync.WaitGroup
+}
+
+// invalidation is the message published for every call to Invalidate.
+type invalidation struct {
+	Keys []string `json:"keys"`
+	// Origin is the ID of the publishing Invalidator, which skips its own invalidations.
+	Origin string `json:"origin,omitempty"`
+	// TraceContext links the handling of the invalidation to where it was published.
+	TraceContext map[string]string `json:"trace_context,omitempty"`
+}
+
+func NewInvalidator(client redis.UniversalClient, opts InvalidatorOptions) *Invalidator {
+	if opts.Channel == "" {
+		opts.Channel = defaultInvalidationChannel
+	}
+
+	return &Invalidator{
+		client:  client,
+		id:      uuid.NewString(),
+		channel: opts.Channel,
+		breaker: opts.Breaker,
+	}
+}
+
+// OnInvalidate registers h to be called for every invalidation received.
+func (i *Invalidator) OnInvalidate(h InvalidationHandler) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.handlers = append(i.handlers, h)
+}
+
+// Invalidate calls the handlers of this instance, then deletes keys from Redis and tells
+// the other instances about it. The handlers are called right away rather than on receipt
+// of the invalidation, so this instance stops serving what it derived from keys even when
+// Redis fails.
+func (i *Invalidator) Invalidate(ctx context.Context, keys ...string) (err error) {
+	ctx, span := tracer.Start(ctx, "cache invalidate",
+		trace.WithAttributes(keysKey.StringSlice(keys)),
+		trace.WithSpanKind(trace.SpanKindProducer),
+	)
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+
+	i.notify(ctx, keys)
+
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	data, err := json.Marshal(&invalidation{Keys: keys, Origin: i.id, TraceContext: carrier})
+	if err != nil {
+		return err
+	}
+
+	return callRedis(ctx, i.breaker, func(ctx context.Context) error {
+		if err := i.client.Del(ctx, keys...).Err(); err != nil {
+			return err
+		}
+		return i.client.Publish(ctx, i.channel, data).Err()
+	})
+}
+
+// Start subscribes to the invalidations of other instances. Redis reconnects the
+// subscription on its own, but invalidations published while it is down are lost, so
+// cached values must still expire.
+func (i *Invalidator) Start() {
+	ctx := context.Background()
+	i.pubsub = i.client.Subscribe(ctx, i.channel)
+	i.wg.Add(1)
+
+	log.Info(ctx, "Starting cache invalidator", "channel", i.channel)
+	go func() {
+		defer i.wg.Done()
+
+		for msg := range i.pubsub.Channel() {
+			i.handle(msg)
+		}
+	}()
+}
+
+func (i *Invalidator) Stop() {
+	log.Info(context.Background(), "Stopping cache invalidator", "channel", i.channel)
+	_ = i.pubsub.Close()
+	i.wg.Wait()
+}
+
+// handle calls the handlers within a span linked to the span which published msg, unless
+// msg was published by this instance, whose handlers were already called.
+func (i *Invalidator) handle(msg *redis.Message) {
+	var inv invalidation
+	if err := json.Unmarshal([]byte(msg.Payload), &inv); err != nil {
+		log.Error(context.Background(), "failed to decode cache invalidation", "error", err)
+		return
+	}
+	if inv.Origin == i.id {
+		return
+	}
+
+	pubCtx := otel.GetTextMapPropagator().Extract(context.Background(), propagation.MapCarrier(inv.TraceContext))
+	ctx, span := tracer.Start(context.Background(), "cache invalidation",
+		trace.WithAttributes(keysKey.StringSlice(inv.Keys)),
+		trace.WithLinks(trace.LinkFromContext(pubCtx)),
+		trace.WithSpanKind(trace.SpanKindConsumer),
+	)
+	defer span.End()
+
+	i.notify(ctx, inv.Keys)
+}
+
+func (i *Invalidator) notify(ctx context.Context, keys []string) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	for _, h := range i.handlers {
+		h(ctx, keys)
+	}
+}
@@ -0,0 +1,127 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Reasons for evicting a value from the in-process tier.
+const (
+	evictionSize        = "size"
+	evictionExpired     = "expired"
+	evictionInvalidated = "invalidated"
+)
+
+// memory is the in-process tier of a cache, evicting the least recently used values
+// beyond its size. A nil memory holds nothing.
+type memory[T any] struct {
+	size int
+	ttl  time.Duration
+	// followExpiry also expires values with their Redis expiry, unlike the last good
+	// values kept for serving stale.
+	followExpiry bool
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+type memoryEntry[T any] struct {
+	key       string
+	entry     *entry[T]
+	expiresAt time.Time
+}
+
+func newMemory[T any](size int, ttl time.Duration, followExpiry bool) *memory[T] {
+	if size <= 0 {
+		return nil
+	}
+
+	return &memory[T]{
+		size:         size,
+		ttl:          ttl,
+		followExpiry: followExpiry,
+		entries:      make(map[string]*list.Element),
+		order:        list.New(),
+	}
+}
+
+// get returns the entry at key, or the reason it was evicted if it expired.
+func (m *memory[T]) get(key string) (*entry[T], string, bool) {
+	if m == nil {
+		return nil, "", false
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	elem, ok := m.entries[key]
+	if !ok {
+		return nil, "", false
+	}
+	if time.Now().After(elem.Value.(*memoryEntry[T]).expiresAt) {
+		m.remove(elem)
+		return nil, evictionExpired, false
+	}
+	m.order.MoveToFront(elem)
+
+	return elem.Value.(*memoryEntry[T]).entry, "", true
+}
+
+// add stores e at key until its TTL or, when following it, the expiry of e, whichever
+// comes first, and returns the number of entries evicted to make room for it.
+func (m *memory[T]) add(key string, e *entry[T]) int {
+	if m == nil {
+		return 0
+	}
+
+	expiresAt := time.Now().Add(m.ttl)
+	if expiry := time.UnixMilli(e.Expiry); m.followExpiry && e.Expiry > 0 && expiry.Before(expiresAt) {
+		expiresAt = expiry
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if elem, ok := m.entries[key]; ok {
+		me := elem.Value.(*memoryEntry[T])
+		me.entry, me.expiresAt = e, expiresAt
+		m.order.MoveToFront(elem)
+		return 0
+	}
+
+	m.entries[key] = m.order.PushFront(&memoryEntry[T]{key: key, entry: e, expiresAt: expiresAt})
+	evicted := 0
+	for m.order.Len() > m.size {
+		m.remove(m.order.Back())
+		evicted++
+	}
+
+	return evicted
+}
+
+// delete removes keys and returns the number of them which were present.
+func (m *memory[T]) delete(keys ...string) int {
+	if m == nil {
+		return 0
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	deleted := 0
+	for _, key := range keys {
+		if elem, ok := m.entries[key]; ok {
+			m.remove(elem)
+			deleted++
+		}
+	}
+
+	return deleted
+}
+
+func (m *memory[T]) remove(elem *list.Element) {
+	m.order.Remove(elem)
+	delete(m.entries, elem.Value.(*memoryEntry[T]).key)
+}
@@ -0,0 +1,202 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/vncats/otel-demo/pkg/otel/sdk"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+const (
+	scopeName     = "github.com/vncats/otel-demo/cache"
+	hitsName      = "cache.hits"
+	missesName    = "cache.misses"
+	evictionsName = "cache.evictions"
+	errorsName    = "cache.errors"
+	fallbacksName = "cache.fallbacks"
+	sizeName      = "cache.value.size"
+	durationName  = "cache.duration"
+	degradedName  = "cache.degraded"
+
+	degradedEventName = "cache.degraded"
+)
+
+// Degraded modes of serving a value, recorded as the cache.degradation attribute.
+const (
+	degradationFailOpen   = "fail_open"
+	degradationServeStale = "serve_stale"
+)
+
+// Operations on Redis, recorded as the cache.operation attribute of errors and sizes.
+const (
+	operationRead   = "read"
+	operationWrite  = "write"
+	operationDelete = "delete"
+	operationEncode = "encode"
+	operationDecode = "decode"
+)
+
+// Tiers of a cache, recorded as the cache.tier attribute.
+const (
+	TierMemory = "memory"
+	TierRedis  = "redis"
+)
+
+var (
+	tracer = otel.Tracer(scopeName)
+	meter  = otel.Meter(scopeName)
+
+	nameKey        = attribute.Key("cache.name")
+	tierKey        = attribute.Key("cache.tier")
+	reasonKey      = attribute.Key("cache.eviction.reason")
+	operationKey   = attribute.Key("cache.operation")
+	hitKey         = attribute.Key("cache.hit")
+	degradationKey = attribute.Key("cache.degradation")
+)
+
+// sizeBoundaries are the bucket boundaries of value sizes, in bytes.
+var sizeBoundaries = []float64{0, 64, 256, 1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20}
+
+type metrics struct {
+	attributes []attribute.KeyValue
+
+	hitCounter      metric.Int64Counter
+	missCounter     metric.Int64Counter
+	evictionCounter metric.Int64Counter
+	errorCounter    metric.Int64Counter
+	fallbackCounter metric.Int64Counter
+	degradedCounter metric.Int64Counter
+
+	sizeHistogram     metric.Int64Histogram
+	durationHistogram metric.Float64Histogram
+}
+
+func newMetrics(name string) (*metrics, error) {
+	m := &metrics{
+		attributes: []attribute.KeyValue{nameKey.String(name)},
+	}
+
+	var err error
+	m.hitCounter, err = meter.Int64Counter(
+		hitsName,
+		metric.WithUnit("{lookup}"),
+		metric.WithDescription("Number of lookups which found a value, by tier."),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	m.missCounter, err = meter.Int64Counter(
+		missesName,
+		metric.WithUnit("{lookup}"),
+		metric.WithDescription("Number of lookups which found no value, by tier."),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	m.evictionCounter, err = meter.Int64Counter(
+		evictionsName,
+		metric.WithUnit("{value}"),
+		metric.WithDescription("Number of values evicted from the in-process tier, by reason."),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	m.errorCounter, err = meter.Int64Counter(
+		errorsName,
+		metric.WithUnit("{error}"),
+		metric.WithDescription("Number of failed Redis operations, by operation."),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	m.fallbackCounter, err = meter.Int64Counter(
+		fallbacksName,
+		metric.WithUnit("{load}"),
+		metric.WithDescription("Number of values loaded from the source of truth on a miss."),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	m.degradedCounter, err = meter.Int64Counter(
+		degradedName,
+		metric.WithUnit("{lookup}"),
+		metric.WithDescription("Number of lookups served despite a failure, by degradation."),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	m.sizeHistogram, err = meter.Int64Histogram(
+		sizeName,
+		metric.WithUnit("By"),
+		metric.WithDescription("Size of the values read from and written to Redis."),
+		metric.WithExplicitBucketBoundaries(sizeBoundaries...),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	m.durationHistogram, err = meter.Float64Histogram(
+		durationName,
+		metric.WithUnit("s"),
+		metric.WithDescription("Duration of getting a value, loading it included on a miss."),
+		metric.WithExplicitBucketBoundaries(sdk.HistogramBoundariesSeconds()...),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func (m *metrics) recordHit(ctx context.Context, tier string) {
+	m.hitCounter.Add(ctx, 1, metric.WithAttributes(append(m.attributes, tierKey.String(tier))...))
+}
+
+func (m *metrics) recordMiss(ctx context.Context, tier string) {
+	m.missCounter.Add(ctx, 1, metric.WithAttributes(append(m.attributes, tierKey.String(tier))...))
+}
+
+func (m *metrics) recordEvictions(ctx context.Context, reason string, n int) {
+	if n == 0 {
+		return
+	}
+	m.evictionCounter.Add(ctx, int64(n), metric.WithAttributes(append(m.attributes,
+		tierKey.String(TierMemory),
+		reasonKey.String(reason),
+	)...))
+}
+
+func (m *metrics) recordError(ctx context.Context, operation string) {
+	m.errorCounter.Add(ctx, 1, metric.WithAttributes(append(m.attributes, operationKey.String(operation))...))
+}
+
+func (m *metrics) recordFallback(ctx context.Context, err error) {
+	attrs := m.attributes
+	if err != nil {
+		attrs = append(attrs, semconv.ErrorTypeKey.String(fmt.Sprintf("%T", err)))
+	}
+	m.fallbackCounter.Add(ctx, 1, metric.WithAttributes(attrs...))
+}
+
+func (m *metrics) recordSize(ctx context.Context, operation string, size int) {
+	m.sizeHistogram.Record(ctx, int64(size), metric.WithAttributes(append(m.attributes, operationKey.String(operation))...))
+}
+
+func (m *metrics) recordDuration(ctx context.Context, startTime time.Time, hit bool) {
+	m.durationHistogram.Record(ctx, time.Since(startTime).Seconds(), metric.WithAttributes(append(m.attributes, hitKey.Bool(hit))...))
+}
+
+func (m *metrics) recordDegraded(ctx context.Context, degradation string) {
+	m.degradedCounter.Add(ctx, 1, metric.WithAttributes(append(m.attributes, degradationKey.String(degradation))...))
+}
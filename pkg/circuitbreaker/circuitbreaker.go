@@ -0,0 +1,263 @@
+package circuitbreaker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/vncats/otel-demo/pkg/otel/log"
+)
+
+// ErrOpen is returned without calling the operation while the breaker is open, or
+// half-open with all trial requests in flight.
+var ErrOpen = errors.New("circuit breaker is open")
+
+const (
+	defaultFailureThreshold = 5
+	defaultWindow           = 10 * time.Second
+	defaultOpenTimeout      = 30 * time.Second
+	defaultHalfOpenRequests = 1
+)
+
+type State int
+
+const (
+	// StateClosed lets every request through, counting failures.
+	StateClosed State = iota
+	// StateHalfOpen lets a limited number of trial requests through.
+	StateHalfOpen
+	// StateOpen rejects every request until OpenTimeout elapsed.
+	StateOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case StateClosed:
+		return "closed"
+	case StateHalfOpen:
+		return "half-open"
+	case StateOpen:
+		return "open"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(s))
+	}
+}
+
+type Options struct {
+	// Name identifies the breaker in logs and metrics.
+	Name string
+	// FailureThreshold is the number of failures within Window which opens the breaker.
+	FailureThreshold int
+	Window           time.Duration
+	// OpenTimeout is how long the breaker stays open before letting trial requests through.
+	OpenTimeout time.Duration
+	// HalfOpenRequests is the number of trial requests allowed while half-open, all of
+	// which must succeed to close the breaker again.
+	HalfOpenRequests int
+	// IsFailure reports whether an error counts as a failure. By default every error
+	// does, except context cancellation and ErrOpen from a nested breaker.
+	IsFailure func(err error) bool
+	// OnStateChange is called, with the lock of the breaker held, on every state change.
+	OnStateChange func(name string, from, to State)
+}
+
+// Breaker stops calling an operation which keeps failing, so that callers fail fast
+// instead of waiting on a dependency which is down.
+type Breaker struct {
+	name             string
+	failureThreshold int
+	window           time.Duration
+	openTimeout      time.Duration
+	halfOpenRequests int
+	isFailure        func(err error) bool
+	onStateChange    func(name string, from, to State)
+	metrics          *metrics
+
+	mu sync.Mutex
+	// generation changes on every state change and window reset, so that the outcome
+	// of a request started in a previous generation is ignored.
+	generation uint64
+	state      State
+	expiry     time.Time
+	failures   int
+	inflight   int
+	successes  int
+}
+
+func New(opts Options) (*Breaker, error) {
+	if opts.FailureThreshold <= 0 {
+		opts.FailureThreshold = defaultFailureThreshold
+	}
+
+	if opts.Window <= 0 {
+		opts.Window = defaultWindow
+	}
+
+	if opts.OpenTimeout <= 0 {
+		opts.OpenTimeout = defaultOpenTimeout
+	}
+
+	if opts.HalfOpenRequests <= 0 {
+		opts.HalfOpenRequests = defaultHalfOpenRequests
+	}
+
+	if opts.IsFailure == nil {
+		opts.IsFailure = DefaultIsFailure
+	}
+
+	if opts.OnStateChange == nil {
+		opts.OnStateChange = noopStateChange
+	}
+
+	m, err := newMetrics(opts.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &Breaker{
+		name:             opts.Name,
+		failureThreshold: opts.FailureThreshold,
+		window:           opts.Window,
+		openTimeout:      opts.OpenTimeout,
+		halfOpenRequests: opts.HalfOpenRequests,
+		isFailure:        opts.IsFailure,
+		onStateChange:    opts.OnStateChange,
+		metrics:          m,
+		expiry:           time.Now().Add(opts.Window),
+	}
+	m.recordState(context.Background(), StateClosed)
+
+	return b, nil
+}
+
+// State returns the current state of the breaker.
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.currentState(time.Now())
+}
+
+// Execute calls fn unless the breaker is open, in which case it returns ErrOpen.
+func (b *Breaker) Execute(ctx context.Context, fn func(ctx context.Context) error) error {
+	generation, err := b.before(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = fn(ctx)
+	b.after(ctx, generation, err)
+
+	return err
+}
+
+// Do is Execute for operations returning a value.
+func Do[T any](ctx context.Context, b *Breaker, fn func(ctx context.Context) (T, error)) (T, error) {
+	var result T
+	err := b.Execute(ctx, func(ctx context.Context) error {
+		var err error
+		result, err = fn(ctx)
+		return err
+	})
+
+	return result, err
+}
+
+func (b *Breaker) before(ctx context.Context) (uint64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	state := b.currentState(time.Now())
+	if state == StateOpen || (state == StateHalfOpen && b.inflight >= b.halfOpenRequests) {
+		b.metrics.recordRejected(ctx)
+		return 0, fmt.Errorf("%w: %s", ErrOpen, b.name)
+	}
+	b.inflight++
+
+	return b.generation, nil
+}
+
+func (b *Breaker) after(ctx context.Context, generation uint64, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	state := b.currentState(now)
+	if generation != b.generation {
+		return
+	}
+	b.inflight--
+
+	if err != nil && !b.isFailure(err) {
+		// the request tells nothing about the dependency, e.g. it was cancelled, so a
+		// trial request only frees its slot for another one
+		return
+	}
+
+	if err != nil {
+		b.failures++
+		if state == StateHalfOpen || b.failures >= b.failureThreshold {
+			b.setState(ctx, StateOpen, now)
+		}
+		return
+	}
+
+	if state == StateHalfOpen {
+		b.successes++
+		if b.successes >= b.halfOpenRequests {
+			b.setState(ctx, StateClosed, now)
+		}
+	}
+}
+
+// currentState moves the breaker to half-open once the open timeout elapsed, and resets
+// the failure count of a closed breaker every window.
+func (b *Breaker) currentState(now time.Time) State {
+	if b.expiry.IsZero() || now.Before(b.expiry) {
+		return b.state
+	}
+
+	switch b.state {
+	case StateOpen:
+		b.setState(context.Background(), StateHalfOpen, now)
+	case StateClosed:
+		b.newGeneration(now)
+	}
+
+	return b.state
+}
+
+func (b *Breaker) setState(ctx context.Context, state State, now time.Time) {
+	from := b.state
+	b.state = state
+	b.newGeneration(now)
+
+	log.Warn(ctx, "circuit breaker state changed", "breaker", b.name, "from", from.String(), "to", state.String())
+	b.metrics.recordStateChange(ctx, from, state)
+	b.onStateChange(b.name, from, state)
+}
+
+func (b *Breaker) newGeneration(now time.Time) {
+	b.generation++
+	b.failures, b.successes, b.inflight = 0, 0, 0
+
+	switch b.state {
+	case StateClosed:
+		b.expiry = now.Add(b.window)
+	case StateOpen:
+		b.expiry = now.Add(b.openTimeout)
+	case StateHalfOpen:
+		// trial requests decide when the breaker leaves the half-open state
+		b.expiry = time.Time{}
+	}
+}
+
+// DefaultIsFailure counts every error as a failure, except context cancellation and
+// ErrOpen from a nested breaker.
+func DefaultIsFailure(err error) bool {
+	return !errors.Is(err, context.Canceled) && !errors.Is(err, ErrOpen)
+}
+
+func noopStateChange(_ string, _, _ State) {}
@@ -0,0 +1,74 @@
+package circuitbreaker
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBreaker(t *testing.T) {
+	ctx := context.Background()
+	errFailed := errors.New("failed")
+
+	var changes []State
+	b, err := New(Options{
+		Name:             "test",
+		FailureThreshold: 2,
+		Window:           time.Minute,
+		OpenTimeout:      10 * time.Millisecond,
+		OnStateChange: func(_ string, _, to State) {
+			changes = append(changes, to)
+		},
+	})
+	require.NoError(t, err)
+
+	fail := func(context.Context) error { return errFailed }
+	succeed := func(context.Context) error { return nil }
+
+	require.ErrorIs(t, b.Execute(ctx, fail), errFailed)
+	require.Equal(t, StateClosed, b.State())
+	require.ErrorIs(t, b.Execute(ctx, fail), errFailed)
+	require.Equal(t, StateOpen, b.State())
+	require.ErrorIs(t, b.Execute(ctx, succeed), ErrOpen)
+
+	// a failed trial request opens the breaker again
+	time.Sleep(15 * time.Millisecond)
+	require.Equal(t, StateHalfOpen, b.State())
+	require.ErrorIs(t, b.Execute(ctx, fail), errFailed)
+	require.Equal(t, StateOpen, b.State())
+
+	time.Sleep(15 * time.Millisecond)
+	value, err := Do(ctx, b, func(context.Context) (int, error) { return 1, nil })
+	require.NoError(t, err)
+	require.Equal(t, 1, value)
+	require.Equal(t, StateClosed, b.State())
+
+	require.Equal(t, []State{StateOpen, StateHalfOpen, StateOpen, StateHalfOpen, StateClosed}, changes)
+
+	// cancellations are not failures
+	for range 3 {
+		require.ErrorIs(t, b.Execute(ctx, func(context.Context) error { return context.Canceled }), context.Canceled)
+	}
+	require.Equal(t, StateClosed, b.State())
+}
+
+func TestBreakerHalfOpenNeutralResult(t *testing.T) {
+	ctx := context.Background()
+	b, err := New(Options{Name: "test", FailureThreshold: 1, OpenTimeout: 10 * time.Millisecond})
+	require.NoError(t, err)
+
+	require.Error(t, b.Execute(ctx, func(context.Context) error { return errors.New("failed") }))
+	time.Sleep(15 * time.Millisecond)
+	require.Equal(t, StateHalfOpen, b.State())
+
+	// a cancelled trial request neither closes nor opens the breaker, and frees its slot
+	canceled := func(context.Context) error { return context.Canceled }
+	require.ErrorIs(t, b.Execute(ctx, canceled), context.Canceled)
+	require.Equal(t, StateHalfOpen, b.State())
+
+	require.NoError(t, b.Execute(ctx, func(context.Context) error { return nil }))
+	require.Equal(t, StateClosed, b.State())
+}
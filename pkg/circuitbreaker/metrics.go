@@ -0,0 +1,84 @@
+package circuitbreaker
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+const (
+	scopeName        = "github.com/vncats/otel-demo/circuitbreaker"
+	stateName        = "circuitbreaker.state"
+	stateChangesName = "circuitbreaker.state_changes"
+	rejectedName     = "circuitbreaker.rejected"
+)
+
+var (
+	meter = otel.Meter(scopeName)
+
+	nameKey = attribute.Key("circuitbreaker.name")
+	fromKey = attribute.Key("circuitbreaker.state.from")
+	toKey   = attribute.Key("circuitbreaker.state.to")
+)
+
+type metrics struct {
+	attributes []attribute.KeyValue
+
+	stateGauge         metric.Int64Gauge
+	stateChangeCounter metric.Int64Counter
+	rejectedCounter    metric.Int64Counter
+}
+
+func newMetrics(name string) (*metrics, error) {
+	m := &metrics{
+		attributes: []attribute.KeyValue{nameKey.String(name)},
+	}
+
+	var err error
+	m.stateGauge, err = meter.Int64Gauge(
+		stateName,
+		metric.WithUnit("{state}"),
+		metric.WithDescription("Current state of the circuit breaker: 0 closed, 1 half-open, 2 open."),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	m.stateChangeCounter, err = meter.Int64Counter(
+		stateChangesName,
+		metric.WithUnit("{change}"),
+		metric.WithDescription("Number of state changes of the circuit breaker."),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	m.rejectedCounter, err = meter.Int64Counter(
+		rejectedName,
+		metric.WithUnit("{request}"),
+		metric.WithDescription("Number of requests rejected by the circuit breaker."),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func (m *metrics) recordState(ctx context.Context, state State) {
+	m.stateGauge.Record(ctx, int64(state), metric.WithAttributes(m.attributes...))
+}
+
+func (m *metrics) recordStateChange(ctx context.Context, from, to State) {
+	m.recordState(ctx, to)
+	m.stateChangeCounter.Add(ctx, 1, metric.WithAttributes(append(m.attributes,
+		fromKey.String(from.String()),
+		toKey.String(to.String()),
+	)...))
+}
+
+func (m *metrics) recordRejected(ctx context.Context) {
+	m.rejectedCounter.Add(ctx, 1, metric.WithAttributes(m.attributes...))
+}
@@ -0,0 +1,175 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/vncats/otel-demo/pkg/otel/log"
+	"github.com/vncats/otel-demo/pkg/retry"
+)
+
+// BatchHandler handles a batch of messages at once. To fail only some messages of the
+// batch, it returns a *BatchError: the failed messages are dead-lettered or redelivered
+// and the others are marked as handled. Any other error fails every message of the batch.
+// With CommitModeTransaction, a partial failure still aborts the whole transaction, so
+// every message fails.
+type BatchHandler func(ctx context.Context, msgs []*kafka.Message) error
+
+// BatchError maps the messages of a batch which failed to their error.
+type BatchError struct {
+	Errs map[*kafka.Message]error
+}
+
+// Add records that msg failed with err, unless err is nil.
+func (e *BatchError) Add(msg *kafka.Message, err error) {
+	if err == nil {
+		return
+	}
+	if e.Errs == nil {
+		e.Errs = make(map[*kafka.Message]error)
+	}
+	e.Errs[msg] = err
+}
+
+// Err returns e if a message failed, or nil.
+func (e *BatchError) Err() error {
+	if len(e.Errs) == 0 {
+		return nil
+	}
+	return e
+}
+
+func (e *BatchError) Error() string {
+	for _, err := range e.Errs {
+		return fmt.Sprintf("%d messages of the batch failed, e.g.: %v", len(e.Errs), err)
+	}
+	return "no message of the batch failed"
+}
+
+// errorOf returns the error of msg, given the error returned by a batch handler.
+func errorOf(msg *kafka.Message, err error) error {
+	var batchErr *BatchError
+	if errors.As(err, &batchErr) {
+		return batchErr.Errs[msg]
+	}
+	return err
+}
+
+// HandleBatchWithRetry retries the messages of a batch which failed according to cfg,
+// without handling the other ones again. Messages which failed with an error which is not
+// retryable, or still failed once retries are exhausted, are reported in a *BatchError
+// with a *RetryError each.
+func HandleBatchWithRetry(fn BatchHandler, cfg retry.Config) BatchHandler {
+	return func(ctx context.Context, msgs []*kafka.Message) error {
+		result := &BatchError{}
+		pending, attempts := msgs, 0
+		// errs holds the last error of every pending message
+		errs := make(map[*kafka.Message]error, len(msgs))
+
+		err := retry.DoCtx(ctx, func(ctx context.Context) error {
+			attempts++
+			err := fn(ctx, pending)
+
+			var retryable []*kafka.Message
+			var retryableErrs []error
+			for _, msg := range pending {
+				msgErr := errorOf(msg, err)
+				switch {
+				case msgErr == nil:
+				case retry.IsPermanent(msgErr):
+					result.Add(msg, &RetryError{Attempts: attempts, Err: msgErr})
+				default:
+					retryable = append(retryable, msg)
+					retryableErrs = append(retryableErrs, msgErr)
+					errs[msg] = msgErr
+				}
+			}
+
+			pending = retryable
+			return errors.Join(retryableErrs...)
+		}, cfg)
+
+		if err != nil {
+			for _, msg := range pending {
+				msgErr := errs[msg]
+				if ctx.Err() != nil {
+					msgErr = err
+				}
+				result.Add(msg, &RetryError{Attempts: attempts, Err: msgErr})
+			}
+		}
+
+		return result.Err()
+	}
+}
+
+const (
+	defaultBatchSize    = 100
+	defaultBatchTimeout = time.Second
+)
+
+// batcher accumulates polled messages until the batch is full or has waited long enough.
+type batcher struct {
+	size    int
+	timeout time.Duration
+
+	msgs    []*kafka.Message
+	started time.Time
+}
+
+func newBatcher(size int, timeout time.Duration) *batcher {
+	if size <= 0 {
+		size = defaultBatchSize
+	}
+	if timeout <= 0 {
+		timeout = defaultBatchTimeout
+	}
+
+	return &batcher{size: size, timeout: timeout}
+}
+
+func (b *batcher) add(msg *kafka.Message) {
+	if len(b.msgs) == 0 {
+		b.started = time.Now()
+	}
+	b.msgs = append(b.msgs, msg)
+}
+
+func (b *batcher) ready() bool {
+	return len(b.msgs) >= b.size || (len(b.msgs) > 0 && time.Since(b.started) >= b.timeout)
+}
+
+func (b *batcher) take() []*kafka.Message {
+	msgs := b.msgs
+	b.msgs = nil
+	return msgs
+}
+
+// flushBatch hands the accumulated messages to the batch handler once the batch is ready.
+func (c *Consumer) flushBatch(ctx context.Context) {
+	if c.batcher == nil || !c.batcher.ready() {
+		return
+	}
+
+	c.handleBatch(ctx, c.batcher.take())
+}
+
+func (c *Consumer) handleBatch(ctx context.Context, msgs []*kafka.Message) {
+	handleCtx, end := ctx, func(error) {}
+	if c.tracer != nil {
+		handleCtx, end = c.tracer.StartBatchSpan(ctx, msgs)
+	}
+
+	err := c.transact(handleCtx, msgs, func(ctx context.Context) error {
+		return safeCall(func() error { return c.batchHandler(ctx, msgs) })
+	})
+	end(err)
+
+	if err != nil {
+		log.Error(ctx, "failed to handle batch", "error", err, "size", len(msgs))
+	}
+	c.finish(ctx, msgs, err)
+}
@@ -0,0 +1,49 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/stretchr/testify/require"
+	"github.com/vncats/otel-demo/pkg/retry"
+)
+
+func TestHandleBatchWithRetry(t *testing.T) {
+	topic := "movie.rating"
+	msgs := make([]*kafka.Message, 3)
+	for i := range msgs {
+		msgs[i] = &kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &topic, Offset: kafka.Offset(i)}}
+	}
+	good, malformed, flaky := msgs[0], msgs[1], msgs[2]
+
+	errMalformed, errFlaky := errors.New("malformed"), errors.New("flaky")
+	handled := map[*kafka.Message]int{}
+	handler := HandleBatchWithRetry(func(_ context.Context, msgs []*kafka.Message) error {
+		batchErr := &BatchError{}
+		for _, msg := range msgs {
+			handled[msg]++
+			switch {
+			case msg == malformed:
+				batchErr.Add(msg, retry.Permanent(errMalformed))
+			case msg == flaky && handled[msg] < 3:
+				batchErr.Add(msg, errFlaky)
+			}
+		}
+		return batchErr.Err()
+	}, retry.Config{InitialInterval: time.Millisecond, MaxInterval: time.Millisecond, Multiplier: 1, MaxRetries: 5})
+
+	err := handler(context.Background(), msgs)
+
+	var batchErr *BatchError
+	require.ErrorAs(t, err, &batchErr)
+	require.Len(t, batchErr.Errs, 1)
+	require.ErrorIs(t, errorOf(malformed, err), errMalformed)
+	require.NoError(t, errorOf(good, err))
+	require.NoError(t, errorOf(flaky, err))
+
+	// only the flaky message was retried
+	require.Equal(t, map[*kafka.Message]int{good: 1, malformed: 1, flaky: 3}, handled)
+}
@@ -0,0 +1,142 @@
+package kafka
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/vncats/otel-demo/pkg/kafka/tracing"
+	"github.com/vncats/otel-demo/pkg/otel/log"
+)
+
+// CommitMode controls when consumed offsets are committed to the broker.
+type CommitMode string
+
+const (
+	// CommitModeAuto lets librdkafka commit polled offsets in the background,
+	// regardless of whether the message handler succeeded.
+	CommitModeAuto CommitMode = "auto"
+	// CommitModeSync commits the offset of every message as soon as its handler returns nil.
+	CommitModeSync CommitMode = "sync"
+	// CommitModeBatch keeps the offsets of handled messages and commits them every CommitInterval.
+	CommitModeBatch CommitMode = "batch"
+	// CommitModeTransaction handles every message, or batch, within a transaction of
+	// ConsumerOptions.TransactionProducer which also commits its offsets, so that the
+	// messages produced by the handler and the consumed offsets are committed atomically.
+	// Offsets of dead-lettered messages are committed every CommitInterval.
+	CommitModeTransaction CommitMode = "transaction"
+)
+
+const defaultCommitInterval = 5 * time.Second
+
+type partitionKey struct {
+	topic     string
+	partition int32
+}
+
+func keyOf(tp kafka.TopicPartition) partitionKey {
+	return partitionKey{topic: *tp.Topic, partition: tp.Partition}
+}
+
+// committer commits the offsets of handled messages as reported by the offset tracker.
+type committer struct {
+	client   ConsumerClient
+	mode     CommitMode
+	interval time.Duration
+	offsets  *offsetTracker
+	metrics  *tracing.ConsumerMetrics
+
+	// mu serializes commits so that concurrent workers never commit an older position.
+	mu         sync.Mutex
+	lastCommit time.Time
+}
+
+func newCommitter(client ConsumerClient, mode CommitMode, interval time.Duration, offsets *offsetTracker, metrics *tracing.ConsumerMetrics) *committer {
+	if interval <= 0 {
+		interval = defaultCommitInterval
+	}
+
+	return &committer{
+		client:     client,
+		mode:       mode,
+		interval:   interval,
+		offsets:    offsets,
+		metrics:    metrics,
+		lastCommit: time.Now(),
+	}
+}
+
+// manual reports whether offsets are committed by the committer rather than librdkafka.
+func (c *committer) manual() bool {
+	return c.mode != CommitModeAuto
+}
+
+// markDone records that msgs have been handled, committing right away in sync mode.
+func (c *committer) markDone(ctx context.Context, msgs ...*kafka.Message) {
+	for _, msg := range msgs {
+		c.offsets.done(msg.TopicPartition)
+	}
+
+	if c.mode == CommitModeSync && len(msgs) > 0 {
+		c.flush(ctx)
+	}
+}
+
+// tick commits pending offsets once the commit interval has elapsed.
+func (c *committer) tick(ctx context.Context) {
+	if c.mode != CommitModeBatch && c.mode != CommitModeTransaction {
+		return
+	}
+
+	c.mu.Lock()
+	due := time.Since(c.lastCommit) >= c.interval
+	c.mu.Unlock()
+
+	if due {
+		c.flush(ctx)
+	}
+}
+
+// flush commits the current position of every partition which moved since its last commit.
+// Offsets which fail to commit are retried by the next flush.
+func (c *committer) flush(ctx context.Context) {
+	if !c.manual() {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lastCommit = time.Now()
+	offsets := c.offsets.committable()
+	if len(offsets) == 0 {
+		return
+	}
+
+	committed, err := c.commit(ctx, offsets)
+	if err == nil {
+		c.offsets.committed(committed)
+	}
+}
+
+func (c *committer) commit(ctx context.Context, offsets []kafka.TopicPartition) ([]kafka.TopicPartition, error) {
+	committed, err := c.client.CommitOffsets(offsets)
+	if committed == nil {
+		committed = offsets
+	}
+	c.metrics.RecordCommit(ctx, committed, err)
+
+	if err != nil {
+		log.Error(ctx, "failed to commit offsets", "error", err, "offsets", offsets)
+		return nil, err
+	}
+	for _, tp := range committed {
+		if tp.Error != nil {
+			log.Error(ctx, "failed to commit partition offset", "error", tp.Error, "offset", tp)
+		}
+	}
+	log.Debug(ctx, "committed offsets", "offsets", committed)
+
+	return committed, nil
+}
@@ -2,8 +2,10 @@ package kafka
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
 	"github.com/vncats/otel-demo/pkg/kafka/tracing"
@@ -18,6 +20,9 @@ const (
 
 type ConsumerClient interface {
 	Poll(timeoutMs int) kafka.Event
+	CommitOffsets(offsets []kafka.TopicPartition) ([]kafka.TopicPartition, error)
+	Seek(partition kafka.TopicPartition, ignoredTimeoutMs int) error
+	GetConsumerGroupMetadata() (*kafka.ConsumerGroupMetadata, error)
 	Close() error
 }
 
@@ -29,18 +34,81 @@ type ConsumerOptions struct {
 
 	EnableTracing bool
 
-	MessageHandler func(msg *kafka.Message) error
-	ErrorHandler   func(err kafka.Error) error
-	OtherHandler   func(ev kafka.Event) error
+	// AssignmentStrategy sets partition.assignment.strategy, e.g. AssignmentCooperativeSticky.
+	AssignmentStrategy string
+
+	// OnAssigned and OnRevoked are called from the polling goroutine on rebalance.
+	// OnRevoked is called once the in-flight messages of the revoked partitions
+	// finished and their offsets were committed.
+	OnAssigned RebalanceHook
+	OnRevoked  RebalanceHook
+
+	// CommitMode defaults to CommitModeAuto. With CommitModeSync and CommitModeBatch an
+	// offset is only committed after its handler returned nil; a failed message is
+	// redelivered by seeking its partition back to the failed offset. Concurrency and
+	// BatchHandler require one of the manual commit modes.
+	CommitMode     CommitMode
+	CommitInterval time.Duration
+
+	// TransactionProducer is the transactional producer used with CommitModeTransaction.
+	// Handlers must produce through it for their messages to be part of the transaction.
+	TransactionProducer *Producer
+
+	// DeadLetter, when set, republishes messages whose handler returned an error
+	// to a dead-letter topic so that they no longer block their partition.
+	DeadLetter *DeadLetterOptions
+
+	// Concurrency is the number of workers handling messages. Messages are routed to
+	// workers by OrderBy so that their relative order is kept, and at most MaxInFlight
+	// polled messages are waiting or being handled. The default of 1 handles messages
+	// one at a time on the polling goroutine. Only contiguous handled offsets are
+	// committed, which CommitModeAuto cannot do.
+	Concurrency int
+	OrderBy     OrderBy
+	MaxInFlight int
+
+	// BatchHandler, when set, replaces MessageHandler: messages are accumulated on the
+	// polling goroutine and handed over once BatchSize messages were polled or the
+	// oldest one waited for BatchTimeout. It requires a manual commit mode.
+	BatchHandler BatchHandler
+	BatchSize    int
+	BatchTimeout time.Duration
+
+	MessageHandler MessageHandler
+	// Middlewares wrap MessageHandler, the first one being the outermost.
+	Middlewares  []Middleware
+	ErrorHandler func(ctx context.Context, err kafka.Error) error
+	OtherHandler func(ctx context.Context, ev kafka.Event) error
 }
 
-type Consumer struct {
-	client ConsumerClient
-
-	messageHandler func(msg *kafka.Message) error
-	errorHandler   func(err kafka.Error) error
-	otherHandler   func(ev kafka.Event) error
+// MessageHandler handles a single message. Its context is cancelled when the consumer
+// stops, carries the process span of the message when tracing is enabled, and has
+// the topic, partition and offset of the message attached for logging.
+type MessageHandler func(ctx context.Context, msg *kafka.Message) error
 
+type Consumer struct {
+	client    ConsumerClient
+	tracer    *tracing.Consumer
+	metrics   *tracing.ConsumerMetrics
+	offsets   *offsetTracker
+	committer *committer
+	pool      *workerPool
+	batcher   *batcher
+
+	deadLetter    *DeadLetterOptions
+	transactional *Producer
+
+	messageHandler MessageHandler
+	batchHandler   BatchHandler
+	errorHandler   func(ctx context.Context, err kafka.Error) error
+	otherHandler   func(ctx context.Context, ev kafka.Event) error
+	onAssigned     RebalanceHook
+	onRevoked      RebalanceHook
+
+	// rebalanceStart is when partitions were last revoked, only accessed from Poll.
+	rebalanceStart time.Time
+
+	ctx    context.Context
 	wg     sync.WaitGroup
 	cancel context.CancelFunc
 }
@@ -49,6 +117,7 @@ func NewConsumer(opts ConsumerOptions) (*Consumer, error) {
 	if opts.MessageHandler == nil {
 		opts.MessageHandler = noopMessageHandler
 	}
+	opts.MessageHandler = Chain(opts.MessageHandler, opts.Middlewares...)
 
 	if opts.ErrorHandler == nil {
 		opts.ErrorHandler = noopErrorHandler
@@ -58,35 +127,96 @@ func NewConsumer(opts ConsumerOptions) (*Consumer, error) {
 		opts.OtherHandler = noopOtherHandler
 	}
 
+	if opts.OnAssigned == nil {
+		opts.OnAssigned = noopRebalanceHook
+	}
+
+	if opts.OnRevoked == nil {
+		opts.OnRevoked = noopRebalanceHook
+	}
+
+	if opts.DeadLetter != nil && (opts.DeadLetter.Topic == "" || opts.DeadLetter.Producer == nil) {
+		return nil, errors.New("dead-letter topic and producer are required")
+	}
+
+	if opts.CommitMode == "" {
+		opts.CommitMode = CommitModeAuto
+	}
+
+	// librdkafka commits the offsets of auto mode as soon as they are polled, before the
+	// queued or batched messages are handled
+	if opts.CommitMode == CommitModeAuto && (opts.Concurrency > 1 || opts.BatchHandler != nil) {
+		return nil, errors.New("concurrent and batch handling require a manual commit mode")
+	}
+
+	if opts.CommitMode == CommitModeTransaction {
+		if opts.TransactionProducer == nil || opts.TransactionProducer.txn == nil {
+			return nil, errors.New("transactional producer is required")
+		}
+		if opts.Concurrency > 1 {
+			return nil, errors.New("transactions require a concurrency of 1")
+		}
+	} else {
+		opts.TransactionProducer = nil
+	}
+
 	kkConfig := kafka.ConfigMap{
-		"bootstrap.servers": opts.Brokers,
-		"group.id":          opts.Group,
-		"auto.offset.reset": opts.Offset,
+		"bootstrap.servers":  opts.Brokers,
+		"group.id":           opts.Group,
+		"auto.offset.reset":  opts.Offset,
+		"enable.auto.commit": opts.CommitMode == CommitModeAuto,
 	}
+	setKafkaConfig(kkConfig, "partition.assignment.strategy", opts.AssignmentStrategy)
 	c, err := kafka.NewConsumer(&kkConfig)
 	if err != nil {
 		return nil, err
 	}
 
-	if err = c.SubscribeTopics(opts.Topics, nil); err != nil {
-		return nil, err
+	wrapOpts := tracing.WrapOptions{
+		Attributes: tracing.GetKafkaAttrs(kkConfig),
 	}
 
 	var client ConsumerClient = c
+	var tracer *tracing.Consumer
 	if opts.EnableTracing {
-		client, err = tracing.WrapConsumer(c, tracing.WrapOptions{
-			Attributes: tracing.GetKafkaAttrs(kkConfig),
-		})
+		tracer, err = tracing.WrapConsumer(c, wrapOpts)
 		if err != nil {
 			return nil, err
 		}
+		client = tracer
+	}
+
+	metrics, err := tracing.NewConsumerMetrics(c, wrapOpts)
+	if err != nil {
+		return nil, err
 	}
 
+	offsets := newOffsetTracker()
 	consumer := &Consumer{
 		client:         client,
+		tracer:         tracer,
+		metrics:        metrics,
+		offsets:        offsets,
+		committer:      newCommitter(client, opts.CommitMode, opts.CommitInterval, offsets, metrics),
+		deadLetter:     opts.DeadLetter,
+		transactional:  opts.TransactionProducer,
 		messageHandler: opts.MessageHandler,
+		batchHandler:   opts.BatchHandler,
 		errorHandler:   opts.ErrorHandler,
 		otherHandler:   opts.OtherHandler,
+		onAssigned:     opts.OnAssigned,
+		onRevoked:      opts.OnRevoked,
+	}
+	if opts.BatchHandler != nil {
+		consumer.batcher = newBatcher(opts.BatchSize, opts.BatchTimeout)
+	} else if opts.Concurrency > 1 {
+		consumer.pool = newWorkerPool(opts.Concurrency, opts.MaxInFlight, opts.OrderBy)
+	}
+
+	consumer.rebalanceStart = time.Now()
+	if err = c.SubscribeTopics(opts.Topics, consumer.rebalance); err != nil {
+		_ = metrics.Close()
+		return nil, err
 	}
 
 	return consumer, nil
@@ -94,10 +224,14 @@ func NewConsumer(opts ConsumerOptions) (*Consumer, error) {
 
 func (c *Consumer) Start() {
 	ctx, cancel := context.WithCancel(context.Background())
-	c.cancel = cancel
+	c.ctx, c.cancel = ctx, cancel
 	c.wg.Add(1)
 
 	log.Info(ctx, "Starting consumer")
+	if c.pool != nil {
+		c.pool.start(ctx, c.handleMessage)
+	}
+
 	go func() {
 		defer c.wg.Done()
 		for {
@@ -106,12 +240,16 @@ func (c *Consumer) Start() {
 				break
 			}
 
-			ev := c.client.Poll(1000)
-			if ev == nil {
-				continue
+			pollStart := time.Now()
+			ev := c.client.Poll(100)
+			if ev != nil {
+				c.handleEvent(ctx, ev)
+			} else {
+				c.metrics.RecordPollIdle(ctx, time.Since(pollStart))
 			}
-
-			c.handleEvent(ev)
+			c.flushBatch(ctx)
+			c.rewindFailed(ctx)
+			c.committer.tick(ctx)
 		}
 	}()
 }
@@ -124,49 +262,197 @@ func (c *Consumer) Stop() {
 
 	log.Info(ctx, "Waiting consumer goroutines to complete")
 	c.wg.Wait()
+	if c.pool != nil {
+		c.pool.stop()
+	}
+	if c.batcher != nil {
+		// unhandled messages are redelivered after a restart
+		for _, msg := range c.batcher.take() {
+			tracing.EndReceiveSpan(msg, nil)
+		}
+	}
+
+	c.committer.flush(ctx)
+	if err := c.metrics.Close(); err != nil {
+		log.Error(ctx, "failed to unregister consumer metrics", "error", err)
+	}
 
 	log.Info(ctx, "Closing consumer")
 	if err := c.client.Close(); err != nil {
-		log.Error(ctx, "failed to close consumer", err)
+		log.Error(ctx, "failed to close consumer", "error", err)
 	}
 
 	log.Info(ctx, "Stopped consumer")
 }
 
-func (c *Consumer) handleEvent(ev kafka.Event) {
-	defer func() {
-		if r := recover(); r != nil {
-			log.Error(context.Background(), fmt.Sprintf("panic: %v", r))
-		}
-	}()
-
-	// handle message
+func (c *Consumer) handleEvent(ctx context.Context, ev kafka.Event) {
 	switch e := ev.(type) {
 	case *kafka.Message:
-		_ = c.messageHandler(e)
+		c.dispatch(ctx, e)
 	case kafka.Error:
-		_ = c.errorHandler(e)
+		if err := safeCall(func() error { return c.errorHandler(ctx, e) }); err != nil {
+			log.Error(ctx, "failed to handle error event", "error", err)
+		}
+	case kafka.OffsetsCommitted:
+		// reported for the commits of librdkafka in CommitModeAuto
+		if e.Error == nil {
+			c.metrics.RecordCommitted(e.Offsets)
+		}
+		if err := safeCall(func() error { return c.otherHandler(ctx, e) }); err != nil {
+			log.Error(ctx, "failed to handle event", "error", err)
+		}
+	default:
+		if err := safeCall(func() error { return c.otherHandler(ctx, e) }); err != nil {
+			log.Error(ctx, "failed to handle event", "error", err)
+		}
+	}
+}
+
+// loopContext returns the context of the poll loop, which is done once the consumer stops.
+func (c *Consumer) loopContext() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
+// dispatch registers msg with the offset tracker and hands it over to the batcher,
+// its worker when a pool is configured, or the message handler.
+func (c *Consumer) dispatch(ctx context.Context, msg *kafka.Message) {
+	if !c.offsets.add(msg.TopicPartition) {
+		// the partition is about to be rewound to an earlier failed message
+		tracing.EndReceiveSpan(msg, nil)
+		return
+	}
+
+	switch {
+	case c.batcher != nil:
+		c.batcher.add(msg)
+		c.flushBatch(ctx)
+	case c.pool != nil:
+		c.pool.submit(ctx, msg)
 	default:
-		_ = c.otherHandler(e)
+		c.handleMessage(ctx, msg)
+	}
+}
+
+// handleMessage handles msg and records the outcome, unless msg was queued behind a
+// failed message of its partition, in which case it is redelivered after that one, or the
+// consumer stopped, in which case its offset is left uncommitted.
+func (c *Consumer) handleMessage(ctx context.Context, msg *kafka.Message) {
+	if c.offsets.skip(msg.TopicPartition) || ctx.Err() != nil {
+		tracing.EndReceiveSpan(msg, nil)
+		return
+	}
+
+	ctx, end := c.startProcessing(ctx, msg)
+
+	err := c.transact(ctx, []*kafka.Message{msg}, func(ctx context.Context) error {
+		return safeCall(func() error { return c.messageHandler(ctx, msg) })
+	})
+	end(err)
+	if err != nil {
+		log.Error(ctx, "failed to handle message", "error", err, "offset", msg.TopicPartition)
 	}
+
+	c.finish(ctx, []*kafka.Message{msg}, err)
 }
 
-func HandleWithRetry[T kafka.Event](fn func(T) error, cfg retry.Config) func(T) error {
-	return func(t T) error {
-		return retry.Do(func() error {
-			return fn(t)
+// finish records the outcome of handling msgs. A failed message is sent to the
+// dead-letter topic if one is configured, or else held back for redelivery when offsets
+// are committed manually. Messages failing because the consumer stops are never
+// dead-lettered. A *BatchError fails only the messages it holds, unless the messages
+// were handled within an aborted transaction.
+func (c *Consumer) finish(ctx context.Context, msgs []*kafka.Message, err error) {
+	done := make([]*kafka.Message, 0, len(msgs))
+	for _, msg := range msgs {
+		msgErr := errorOf(msg, err)
+		if msgErr == nil && err != nil && c.transactional != nil {
+			// the transaction was aborted, taking the message down with the failed ones
+			msgErr = err
+		}
+		if msgErr != nil && c.deadLetter != nil && ctx.Err() == nil {
+			msgErr = c.sendToDeadLetter(ctx, msg, msgErr)
+		}
+		tracing.EndReceiveSpan(msg, msgErr)
+		if msgErr != nil && c.committer.manual() {
+			c.offsets.fail(msg.TopicPartition)
+			continue
+		}
+		done = append(done, msg)
+	}
+
+	c.committer.markDone(ctx, done...)
+}
+
+// rewindFailed seeks every partition with a failed message back to that message, once
+// none of its messages are in flight anymore, so that it is redelivered.
+func (c *Consumer) rewindFailed(ctx context.Context) {
+	for _, tp := range c.offsets.rewindable() {
+		if err := c.client.Seek(tp, 0); err != nil {
+			log.Error(ctx, "failed to seek back to failed message", "error", err, "offset", tp)
+			continue
+		}
+		c.offsets.reset(keyOf(tp))
+	}
+}
+
+// startProcessing returns the context for handling msg, carrying the position of msg as
+// log attributes and either the process span or, without tracing, the propagated trace
+// context. The returned function must be called with the result of the handler.
+func (c *Consumer) startProcessing(ctx context.Context, msg *kafka.Message) (context.Context, func(error)) {
+	ctx = log.WithContext(ctx,
+		"topic", *msg.TopicPartition.Topic,
+		"partition", msg.TopicPartition.Partition,
+		"offset", int64(msg.TopicPartition.Offset),
+	)
+
+	if c.tracer == nil {
+		return tracing.ContextFromMessage(ctx, msg), func(error) {}
+	}
+	return c.tracer.StartProcessSpan(ctx, msg)
+}
+
+// safeCall runs fn and converts a panic into an error.
+func safeCall(fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	return fn()
+}
+
+// HandleWithRetry retries fn according to cfg. Once every attempt failed, fn returned an
+// error which is not retryable, or the consumer stopped, it returns a *RetryError.
+// It wraps message, batch and event handlers alike.
+func HandleWithRetry[T any](fn func(context.Context, T) error, cfg retry.Config) func(context.Context, T) error {
+	return func(ctx context.Context, t T) error {
+		attempts := 0
+		err := retry.DoCtx(ctx, func(ctx context.Context) error {
+			attempts++
+			return fn(ctx, t)
 		}, cfg)
+		if err != nil {
+			return &RetryError{Attempts: attempts, Err: err}
+		}
+		return nil
 	}
 }
 
-func noopMessageHandler(_ *kafka.Message) error {
+func noopMessageHandler(_ context.Context, _ *kafka.Message) error {
+	return nil
+}
+
+func noopErrorHandler(_ context.Context, _ kafka.Error) error {
 	return nil
 }
 
-func noopErrorHandler(_ kafka.Error) error {
+func noopOtherHandler(_ context.Context, _ kafka.Event) error {
 	return nil
 }
 
-func noopOtherHandler(_ kafka.Event) error {
+func noopRebalanceHook(_ context.Context, _ []kafka.TopicPartition) error {
 	return nil
 }
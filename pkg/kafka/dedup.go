@@ -0,0 +1,275 @@
+package kafka
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/vncats/otel-demo/pkg/kafka/tracing"
+	"github.com/vncats/otel-demo/pkg/otel/log"
+)
+
+// HeaderMessageID uniquely identifies a message. It is set by Producer.Produce and
+// Producer.ProduceAsync, unless given with WithMessageID, and kept when a message is
+// dead-lettered.
+const HeaderMessageID = "x-message-id"
+
+const (
+	defaultDedupTTL       = 24 * time.Hour
+	defaultDedupClaimTTL  = time.Minute
+	defaultDedupCacheSize = 100_000
+)
+
+// ErrMessageInProgress is returned for a message whose ID is claimed by another handler,
+// e.g. after a rebalance or when it was produced twice in a row. It is retryable: the
+// message is either processed by then and dropped, or its claim expired.
+var ErrMessageInProgress = errors.New("message is being processed by another handler")
+
+// DedupStore records the IDs of the messages being processed and processed. IDs must be
+// claimed atomically, so that a message handled concurrently is only handled once.
+type DedupStore interface {
+	// Claim records id as in progress for ttl unless it is recorded already. It reports
+	// whether id was claimed and, if not, whether its message was processed.
+	Claim(ctx context.Context, id string, ttl time.Duration) (claimed bool, processed bool, err error)
+	// Complete records id as processed for ttl.
+	Complete(ctx context.Context, id string, ttl time.Duration) error
+	// Release forgets id, so that its message is handled again when redelivered.
+	Release(ctx context.Context, id string) error
+}
+
+// DedupOptions configures Deduplicate and DeduplicateBatch.
+type DedupOptions struct {
+	Store DedupStore
+	// Namespace prefixes the IDs added to Store, usually the consumer group, so that
+	// consumers sharing a store do not drop each other's messages.
+	Namespace string
+	// TTL is how long a processed message is remembered, 24 hours by default.
+	TTL time.Duration
+	// ClaimTTL is how long a message is claimed while being handled, 1 minute by default.
+	// It must exceed the time taken to handle a message, after which a message whose
+	// consumer died is handled again.
+	ClaimTTL time.Duration
+}
+
+// Deduplicate returns a middleware dropping the messages whose ID was already processed
+// successfully. The ID is claimed before handling the message and released if the handler
+// fails, so that a failed message is still redelivered, or recorded as processed
+// otherwise. Messages without HeaderMessageID are always handled, as are messages for
+// which the store fails.
+//
+// Messages are recorded once their handler returned, so deduplication does not suit
+// CommitModeTransaction, whose messages are redelivered when the transaction aborts.
+func Deduplicate(opts DedupOptions) (Middleware, error) {
+	d, err := newDeduplicator(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(next MessageHandler) MessageHandler {
+		return func(ctx context.Context, msg *kafka.Message) error {
+			id, drop, err := d.claim(ctx, msg)
+			if drop || err != nil {
+				return err
+			}
+
+			err = next(ctx, msg)
+			d.finish(ctx, id, err)
+			return err
+		}
+	}, nil
+}
+
+// DeduplicateBatch is the equivalent of Deduplicate for batch handlers: fn is called with
+// the messages of the batch which were not processed yet, and every message is recorded
+// as processed or released depending on its own outcome.
+func DeduplicateBatch(fn BatchHandler, opts DedupOptions) (BatchHandler, error) {
+	d, err := newDeduplicator(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(ctx context.Context, msgs []*kafka.Message) error {
+		result := &BatchError{}
+		ids := make(map[*kafka.Message]string, len(msgs))
+		pending := make([]*kafka.Message, 0, len(msgs))
+		for _, msg := range msgs {
+			id, drop, err := d.claim(ctx, msg)
+			switch {
+			case drop:
+			case err != nil:
+				result.Add(msg, err)
+			default:
+				ids[msg] = id
+				pending = append(pending, msg)
+			}
+		}
+		if len(pending) == 0 {
+			return result.Err()
+		}
+
+		err := fn(ctx, pending)
+		for _, msg := range pending {
+			msgErr := errorOf(msg, err)
+			d.finish(ctx, ids[msg], msgErr)
+			result.Add(msg, msgErr)
+		}
+
+		return result.Err()
+	}, nil
+}
+
+type deduplicator struct {
+	opts    DedupOptions
+	metrics *tracing.DedupMetrics
+}
+
+func newDeduplicator(opts DedupOptions) (*deduplicator, error) {
+	if opts.TTL <= 0 {
+		opts.TTL = defaultDedupTTL
+	}
+	if opts.ClaimTTL <= 0 {
+		opts.ClaimTTL = defaultDedupClaimTTL
+	}
+
+	metrics, err := tracing.NewDedupMetrics()
+	if err != nil {
+		return nil, err
+	}
+
+	return &deduplicator{opts: opts, metrics: metrics}, nil
+}
+
+// claim claims the ID of msg before it is handled. It returns the claimed ID, empty if
+// msg is handled without being recorded, whether msg is a duplicate to drop, or
+// ErrMessageInProgress.
+func (d *deduplicator) claim(ctx context.Context, msg *kafka.Message) (string, bool, error) {
+	id := tracing.NewMessageCarrier(msg).Get(HeaderMessageID)
+	if id == "" {
+		return "", false, nil
+	}
+	if d.opts.Namespace != "" {
+		id = d.opts.Namespace + ":" + id
+	}
+
+	claimed, processed, err := d.opts.Store.Claim(ctx, id, d.opts.ClaimTTL)
+	switch {
+	case err != nil:
+		log.Error(ctx, "failed to claim message", "error", err, "message_id", id)
+		return "", false, nil
+	case claimed:
+		return id, false, nil
+	case processed:
+		d.metrics.RecordDuplicate(ctx, msg)
+		log.Info(ctx, "dropped duplicate message", "message_id", id)
+		return "", true, nil
+	default:
+		return "", false, ErrMessageInProgress
+	}
+}
+
+// finish records the message claimed under id as processed, or releases it if handling
+// it failed.
+func (d *deduplicator) finish(ctx context.Context, id string, err error) {
+	if id == "" {
+		return
+	}
+
+	// the outcome is recorded even when the handler was cancelled
+	ctx = context.WithoutCancel(ctx)
+	if err != nil {
+		if err := d.opts.Store.Release(ctx, id); err != nil {
+			log.Error(ctx, "failed to release message", "error", err, "message_id", id)
+		}
+		return
+	}
+
+	if err := d.opts.Store.Complete(ctx, id, d.opts.TTL); err != nil {
+		log.Error(ctx, "failed to record processed message", "error", err, "message_id", id)
+	}
+}
+
+// MemoryDedupStore is an in-memory DedupStore which evicts the least recently added IDs
+// beyond its size.
+type MemoryDedupStore struct {
+	size int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+type dedupEntry struct {
+	id        string
+	processed bool
+	expiresAt time.Time
+}
+
+var _ DedupStore = (*MemoryDedupStore)(nil)
+
+// NewMemoryDedupStore creates a MemoryDedupStore holding up to size IDs, 100k by default.
+func NewMemoryDedupStore(size int) *MemoryDedupStore {
+	if size <= 0 {
+		size = defaultDedupCacheSize
+	}
+
+	return &MemoryDedupStore{
+		size:    size,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+func (s *MemoryDedupStore) Claim(_ context.Context, id string, ttl time.Duration) (bool, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if elem, ok := s.entries[id]; ok {
+		entry := elem.Value.(*dedupEntry)
+		if time.Now().Before(entry.expiresAt) {
+			return false, entry.processed, nil
+		}
+		s.remove(elem)
+	}
+
+	s.add(&dedupEntry{id: id, expiresAt: time.Now().Add(ttl)})
+	return true, false, nil
+}
+
+func (s *MemoryDedupStore) Complete(_ context.Context, id string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if elem, ok := s.entries[id]; ok {
+		s.remove(elem)
+	}
+	s.add(&dedupEntry{id: id, processed: true, expiresAt: time.Now().Add(ttl)})
+
+	return nil
+}
+
+func (s *MemoryDedupStore) Release(_ context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if elem, ok := s.entries[id]; ok {
+		s.remove(elem)
+	}
+
+	return nil
+}
+
+// add records entry as the most recent one, evicting the oldest entries beyond the size.
+func (s *MemoryDedupStore) add(entry *dedupEntry) {
+	s.entries[entry.id] = s.order.PushFront(entry)
+	for s.order.Len() > s.size {
+		s.remove(s.order.Back())
+	}
+}
+
+func (s *MemoryDedupStore) remove(elem *list.Element) {
+	s.order.Remove(elem)
+	delete(s.entries, elem.Value.(*dedupEntry).id)
+}
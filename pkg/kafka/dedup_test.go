@@ -0,0 +1,116 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeduplicate(t *testing.T) {
+	ctx := context.Background()
+	topic := "movie.rating"
+	newMsg := func(id string) *kafka.Message {
+		return &kafka.Message{
+			TopicPartition: kafka.TopicPartition{Topic: &topic},
+			Headers:        []kafka.Header{{Key: HeaderMessageID, Value: []byte(id)}},
+		}
+	}
+
+	dedup, err := Deduplicate(DedupOptions{Store: NewMemoryDedupStore(2), Namespace: "group"})
+	require.NoError(t, err)
+
+	var handled []string
+	var handleErr error
+	handler := dedup(func(_ context.Context, msg *kafka.Message) error {
+		handled = append(handled, string(msg.Headers[0].Value))
+		return handleErr
+	})
+
+	// failed messages are not recorded
+	handleErr = errors.New("failed")
+	require.Error(t, handler(ctx, newMsg("a")))
+	handleErr = nil
+
+	require.NoError(t, handler(ctx, newMsg("a")))
+	require.NoError(t, handler(ctx, newMsg("a")))
+	require.NoError(t, handler(ctx, newMsg("b")))
+	require.NoError(t, handler(ctx, newMsg("c")))
+	// "a" was evicted by "c"
+	require.NoError(t, handler(ctx, newMsg("a")))
+	require.Equal(t, []string{"a", "a", "b", "c", "a"}, handled)
+}
+
+func TestDeduplicateBatch(t *testing.T) {
+	ctx := context.Background()
+	topic := "movie.rating"
+	newMsg := func(id string) *kafka.Message {
+		return &kafka.Message{
+			TopicPartition: kafka.TopicPartition{Topic: &topic},
+			Headers:        []kafka.Header{{Key: HeaderMessageID, Value: []byte(id)}},
+		}
+	}
+
+	store := NewMemoryDedupStore(0)
+	var handled []string
+	failed := errors.New("failed")
+	handler, err := DeduplicateBatch(func(_ context.Context, msgs []*kafka.Message) error {
+		batchErr := &BatchError{}
+		for _, msg := range msgs {
+			id := string(msg.Headers[0].Value)
+			handled = append(handled, id)
+			if id == "b" {
+				batchErr.Add(msg, failed)
+			}
+		}
+		return batchErr.Err()
+	}, DedupOptions{Store: store})
+	require.NoError(t, err)
+
+	a, b, a2 := newMsg("a"), newMsg("b"), newMsg("a")
+	err = handler(ctx, []*kafka.Message{a, b, a2})
+	require.Equal(t, []string{"a", "b"}, handled)
+	// the second "a" waits for the first one, and "b" is released
+	require.ErrorIs(t, errorOf(a2, err), ErrMessageInProgress)
+	require.ErrorIs(t, errorOf(b, err), failed)
+	require.NoError(t, errorOf(a, err))
+
+	handled = nil
+	err = handler(ctx, []*kafka.Message{a2, b})
+	require.Equal(t, []string{"b"}, handled)
+	require.NoError(t, errorOf(a2, err))
+}
+
+func TestMemoryDedupStoreTTL(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryDedupStore(0)
+
+	claimed, _, err := store.Claim(ctx, "a", time.Millisecond)
+	require.NoError(t, err)
+	require.True(t, claimed)
+
+	claimed, processed, err := store.Claim(ctx, "a", time.Millisecond)
+	require.NoError(t, err)
+	require.False(t, claimed)
+	require.False(t, processed)
+
+	// an expired claim is claimed again
+	time.Sleep(2 * time.Millisecond)
+	claimed, _, err = store.Claim(ctx, "a", time.Millisecond)
+	require.NoError(t, err)
+	require.True(t, claimed)
+
+	require.NoError(t, store.Complete(ctx, "a", time.Millisecond))
+	claimed, processed, err = store.Claim(ctx, "a", time.Millisecond)
+	require.NoError(t, err)
+	require.False(t, claimed)
+	require.True(t, processed)
+
+	time.Sleep(2 * time.Millisecond)
+	claimed, _, err = store.Claim(ctx, "a", time.Millisecond)
+	require.NoError(t, err)
+	require.True(t, claimed)
+}
@@ -0,0 +1,40 @@
+package kafka
+
+import (
+	"context"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+)
+
+// Delivery is the pending delivery report of a message produced asynchronously.
+// It is resolved by the events loop started with Producer.Start.
+type Delivery struct {
+	done chan struct{}
+	msg  *kafka.Message
+	err  error
+}
+
+func newDelivery() *Delivery {
+	return &Delivery{done: make(chan struct{})}
+}
+
+// Done is closed once the delivery report has been received.
+func (d *Delivery) Done() <-chan struct{} {
+	return d.done
+}
+
+// Wait blocks until the message is delivered or ctx is done, and returns the
+// delivered message or the reason it could not be delivered.
+func (d *Delivery) Wait(ctx context.Context) (*kafka.Message, error) {
+	select {
+	case <-d.done:
+		return d.msg, d.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (d *Delivery) resolve(msg *kafka.Message, err error) {
+	d.msg, d.err = msg, err
+	close(d.done)
+}
@@ -0,0 +1,126 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/vncats/otel-demo/pkg/kafka/tracing"
+	"github.com/vncats/otel-demo/pkg/otel/log"
+)
+
+// Headers added to every message republished to a dead-letter topic.
+const (
+	HeaderDLQPrefix            = "x-dlq-"
+	HeaderDLQOriginalTopic     = HeaderDLQPrefix + "original-topic"
+	HeaderDLQOriginalPartition = HeaderDLQPrefix + "original-partition"
+	HeaderDLQOriginalOffset    = HeaderDLQPrefix + "original-offset"
+	HeaderDLQError             = HeaderDLQPrefix + "error"
+	HeaderDLQAttempts          = HeaderDLQPrefix + "attempts"
+)
+
+// DeadLetterOptions configures where messages are sent once their handler gave up.
+type DeadLetterOptions struct {
+	Topic    string
+	Producer *Producer
+}
+
+// RetryError is returned by a handler wrapped with HandleWithRetry once every attempt failed.
+type RetryError struct {
+	Attempts int
+	Err      error
+}
+
+func (e *RetryError) Error() string {
+	return fmt.Sprintf("failed after %d attempts: %v", e.Attempts, e.Err)
+}
+
+func (e *RetryError) Unwrap() error {
+	return e.Err
+}
+
+// sendToDeadLetter republishes msg to the dead-letter topic along with the reason it failed.
+func (c *Consumer) sendToDeadLetter(ctx context.Context, msg *kafka.Message, handleErr error) error {
+	attempts := 1
+	var retryErr *RetryError
+	if errors.As(handleErr, &retryErr) {
+		attempts = retryErr.Attempts
+	}
+
+	topic := c.deadLetter.Topic
+	dlqMsg := &kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
+		Key:            msg.Key,
+		Value:          msg.Value,
+		Headers:        append([]kafka.Header(nil), msg.Headers...),
+	}
+
+	carrier := tracing.NewMessageCarrier(dlqMsg)
+	carrier.Set(HeaderDLQOriginalTopic, *msg.TopicPartition.Topic)
+	carrier.Set(HeaderDLQOriginalPartition, strconv.Itoa(int(msg.TopicPartition.Partition)))
+	carrier.Set(HeaderDLQOriginalOffset, strconv.FormatInt(int64(msg.TopicPartition.Offset), 10))
+	carrier.Set(HeaderDLQError, handleErr.Error())
+	carrier.Set(HeaderDLQAttempts, strconv.Itoa(attempts))
+
+	if _, err := c.deadLetter.Producer.ProduceMessage(dlqMsg); err != nil {
+		return errors.Join(handleErr, fmt.Errorf("send to dead-letter topic: %w", err))
+	}
+
+	log.Warn(ctx, "sent message to dead-letter topic",
+		"error", handleErr,
+		"offset", msg.TopicPartition,
+		"dlq_topic", topic,
+		"attempts", attempts,
+	)
+
+	return nil
+}
+
+// ReplayDeadLetter adapts handler so that it can consume a dead-letter topic. Each message
+// is restored to its original topic, partition and offset, without the dead-letter headers,
+// before being passed to handler.
+func ReplayDeadLetter(handler MessageHandler) MessageHandler {
+	return func(ctx context.Context, msg *kafka.Message) error {
+		original, err := RestoreDeadLetter(msg)
+		if err != nil {
+			return err
+		}
+		return handler(ctx, original)
+	}
+}
+
+// RestoreDeadLetter rebuilds the original message from a dead-letter message.
+func RestoreDeadLetter(msg *kafka.Message) (*kafka.Message, error) {
+	carrier := tracing.NewMessageCarrier(msg)
+
+	topic := carrier.Get(HeaderDLQOriginalTopic)
+	if topic == "" {
+		return nil, fmt.Errorf("missing %s header", HeaderDLQOriginalTopic)
+	}
+	partition, err := strconv.ParseInt(carrier.Get(HeaderDLQOriginalPartition), 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s header: %w", HeaderDLQOriginalPartition, err)
+	}
+	offset, err := strconv.ParseInt(carrier.Get(HeaderDLQOriginalOffset), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s header: %w", HeaderDLQOriginalOffset, err)
+	}
+
+	original := *msg
+	original.TopicPartition = kafka.TopicPartition{
+		Topic:     &topic,
+		Partition: int32(partition),
+		Offset:    kafka.Offset(offset),
+	}
+	original.Headers = nil
+	for _, h := range msg.Headers {
+		if !strings.HasPrefix(h.Key, HeaderDLQPrefix) {
+			original.Headers = append(original.Headers, h)
+		}
+	}
+
+	return &original, nil
+}
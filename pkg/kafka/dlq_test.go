@@ -0,0 +1,41 @@
+package kafka
+
+import (
+	"testing"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRestoreDeadLetter(t *testing.T) {
+	dlqTopic := "movie.rating.dlq"
+	msg := &kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &dlqTopic, Partition: 0, Offset: 7},
+		Key:            []byte("1"),
+		Value:          []byte(`{"movie_id":1}`),
+		Headers: []kafka.Header{
+			{Key: "traceparent", Value: []byte("00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")},
+			{Key: HeaderDLQOriginalTopic, Value: []byte("movie.rating")},
+			{Key: HeaderDLQOriginalPartition, Value: []byte("3")},
+			{Key: HeaderDLQOriginalOffset, Value: []byte("42")},
+			{Key: HeaderDLQError, Value: []byte("boom")},
+			{Key: HeaderDLQAttempts, Value: []byte("6")},
+		},
+	}
+
+	original, err := RestoreDeadLetter(msg)
+	require.NoError(t, err)
+	require.Equal(t, "movie.rating", *original.TopicPartition.Topic)
+	require.Equal(t, int32(3), original.TopicPartition.Partition)
+	require.Equal(t, kafka.Offset(42), original.TopicPartition.Offset)
+	require.Equal(t, msg.Key, original.Key)
+	require.Equal(t, msg.Value, original.Value)
+	require.Equal(t, []kafka.Header{msg.Headers[0]}, original.Headers)
+
+	// the dead-letter message itself is left untouched
+	require.Equal(t, dlqTopic, *msg.TopicPartition.Topic)
+	require.Len(t, msg.Headers, 6)
+
+	_, err = RestoreDeadLetter(&kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &dlqTopic}})
+	require.Error(t, err)
+}
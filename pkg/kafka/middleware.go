@@ -0,0 +1,150 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"slices"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/vncats/otel-demo/pkg/kafka/tracing"
+	"github.com/vncats/otel-demo/pkg/otel/log"
+	"github.com/vncats/otel-demo/pkg/retry"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
+)
+
+// Middleware decorates a MessageHandler.
+type Middleware func(MessageHandler) MessageHandler
+
+// Chain wraps handler with middlewares, the first one being the outermost.
+func Chain(handler MessageHandler, middlewares ...Middleware) MessageHandler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// Recover converts a panic of the handler into an error, which is recorded on the span
+// of ctx along with the stack trace.
+func Recover() Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(ctx context.Context, msg *kafka.Message) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					err = fmt.Errorf("panic: %v", r)
+
+					span := trace.SpanFromContext(ctx)
+					span.RecordError(err, trace.WithAttributes(
+						semconv.ExceptionStacktrace(string(debug.Stack())),
+					))
+					span.SetStatus(codes.Error, err.Error())
+				}
+			}()
+
+			return next(ctx, msg)
+		}
+	}
+}
+
+// Trace runs the handler in a span named name, a child of the process span of the
+// message when the consumer is traced.
+func Trace(name string) Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(ctx context.Context, msg *kafka.Message) error {
+			ctx, end := tracing.StartHandlerSpan(ctx, name, msg)
+			err := next(ctx, msg)
+			end(err)
+			return err
+		}
+	}
+}
+
+// Logging logs the start and outcome of handling every message.
+func Logging() Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(ctx context.Context, msg *kafka.Message) error {
+			startTime := time.Now()
+			log.Debug(ctx, "handling message", "key", string(msg.Key))
+
+			err := next(ctx, msg)
+			if err != nil {
+				log.Error(ctx, "message handler failed", "error", err, "duration", time.Since(startTime))
+				return err
+			}
+
+			log.Debug(ctx, "handled message", "duration", time.Since(startTime))
+			return nil
+		}
+	}
+}
+
+// Metrics counts the messages handled and records how long they took, tagged with name.
+func Metrics(name string) (Middleware, error) {
+	metrics, err := tracing.NewHandlerMetrics(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(next MessageHandler) MessageHandler {
+		return func(ctx context.Context, msg *kafka.Message) error {
+			startTime := time.Now()
+			err := next(ctx, msg)
+			metrics.RecordHandled(ctx, msg, time.Since(startTime), err)
+			return err
+		}
+	}, nil
+}
+
+// Timeout cancels the context of the handler after d.
+func Timeout(d time.Duration) Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(ctx context.Context, msg *kafka.Message) error {
+			ctx, cancel := context.WithTimeout(ctx, d)
+			defer cancel()
+			return next(ctx, msg)
+		}
+	}
+}
+
+// Retry retries the handler according to cfg, see HandleWithRetry.
+func Retry(cfg retry.Config) Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return HandleWithRetry(next, cfg)
+	}
+}
+
+// RateLimit limits the rate of handled messages to limit per second, with bursts of up
+// to burst messages. It blocks until a message is allowed or the context is done.
+func RateLimit(limit rate.Limit, burst int) Middleware {
+	limiter := rate.NewLimiter(limit, burst)
+
+	return func(next MessageHandler) MessageHandler {
+		return func(ctx context.Context, msg *kafka.Message) error {
+			if err := limiter.Wait(ctx); err != nil {
+				return err
+			}
+			return next(ctx, msg)
+		}
+	}
+}
+
+// FilterHeader only passes the messages whose header key has one of values, or, without
+// values, which have the header at all. Other messages are skipped as handled.
+func FilterHeader(key string, values ...string) Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(ctx context.Context, msg *kafka.Message) error {
+			for _, h := range msg.Headers {
+				if h.Key == key && (len(values) == 0 || slices.Contains(values, string(h.Value))) {
+					return next(ctx, msg)
+				}
+			}
+
+			log.Debug(ctx, "skipped message by header filter", "header", key)
+			return nil
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package kafka
+
+import (
+	"context"
+	"testing"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChain(t *testing.T) {
+	ctx := context.Background()
+	topic := "movie.rating"
+
+	var calls []string
+	record := func(name string) Middleware {
+		return func(next MessageHandler) MessageHandler {
+			return func(ctx context.Context, msg *kafka.Message) error {
+				calls = append(calls, name)
+				return next(ctx, msg)
+			}
+		}
+	}
+
+	handler := Chain(func(_ context.Context, _ *kafka.Message) error {
+		calls = append(calls, "handler")
+		panic("boom")
+	}, Recover(), record("outer"), FilterHeader("type", "rating"), record("inner"))
+
+	msg := &kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &topic}}
+	require.NoError(t, handler(ctx, msg))
+	require.Equal(t, []string{"outer"}, calls)
+
+	calls = nil
+	msg.Headers = []kafka.Header{{Key: "type", Value: []byte("rating")}}
+	require.EqualError(t, handler(ctx, msg), "panic: boom")
+	require.Equal(t, []string{"outer", "inner", "handler"}, calls)
+}
@@ -0,0 +1,205 @@
+package kafka
+
+import (
+	"slices"
+	"sync"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+)
+
+// offsetTracker follows the messages of each partition from poll to completion so that
+// only contiguous completed offsets are committed, even when messages finish out of order.
+type offsetTracker struct {
+	mu         sync.Mutex
+	partitions map[partitionKey]*partitionOffsets
+}
+
+type partitionOffsets struct {
+	// offsets holds registered offsets in poll order, up to the first unfinished one.
+	offsets []kafka.Offset
+	done    map[kafka.Offset]struct{}
+	pending int
+
+	// next is the offset to commit, i.e. one past the last contiguous done offset.
+	next      kafka.Offset
+	committed kafka.Offset
+
+	// failed is the lowest offset whose handler failed, or kafka.OffsetInvalid.
+	failed kafka.Offset
+}
+
+func newOffsetTracker() *offsetTracker {
+	return &offsetTracker{partitions: map[partitionKey]*partitionOffsets{}}
+}
+
+func (t *offsetTracker) partition(key partitionKey) *partitionOffsets {
+	p, ok := t.partitions[key]
+	if !ok {
+		p = &partitionOffsets{
+			done:      map[kafka.Offset]struct{}{},
+			next:      kafka.OffsetInvalid,
+			committed: kafka.OffsetInvalid,
+			failed:    kafka.OffsetInvalid,
+		}
+		t.partitions[key] = p
+	}
+	return p
+}
+
+// add registers a polled message. It returns false when the partition is waiting to be
+// rewound to a failed message, in which case the message must not be handled.
+func (t *offsetTracker) add(tp kafka.TopicPartition) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p := t.partition(keyOf(tp))
+	if p.failed != kafka.OffsetInvalid {
+		return false
+	}
+
+	p.offsets = append(p.offsets, tp.Offset)
+	p.pending++
+
+	return true
+}
+
+// skip reports whether a registered message must not be handled because its partition
+// is waiting to be rewound to an earlier failed message, e.g. when it was queued behind
+// the failed one. A skipped message is released, so that it does not hold the rewind back,
+// and is redelivered after the failed message.
+func (t *offsetTracker) skip(tp kafka.TopicPartition) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p, ok := t.partitions[keyOf(tp)]
+	if !ok || p.failed == kafka.OffsetInvalid || tp.Offset <= p.failed || !slices.Contains(p.offsets, tp.Offset) {
+		return false
+	}
+
+	p.pending--
+	return true
+}
+
+// done marks a message as handled and advances the commit position past contiguous done offsets.
+func (t *offsetTracker) done(tp kafka.TopicPartition) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p, ok := t.partitions[keyOf(tp)]
+	if !ok || !slices.Contains(p.offsets, tp.Offset) {
+		return
+	}
+
+	p.pending--
+	p.done[tp.Offset] = struct{}{}
+	for len(p.offsets) > 0 {
+		head := p.offsets[0]
+		if _, ok := p.done[head]; !ok {
+			break
+		}
+		delete(p.done, head)
+		p.offsets = p.offsets[1:]
+		p.next = head + 1
+	}
+}
+
+// fail marks a message as finished without handling it, which holds the commit position
+// of its partition at that offset until the partition is rewound.
+func (t *offsetTracker) fail(tp kafka.TopicPartition) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p, ok := t.partitions[keyOf(tp)]
+	if !ok || !slices.Contains(p.offsets, tp.Offset) {
+		return
+	}
+
+	p.pending--
+	if p.failed == kafka.OffsetInvalid || tp.Offset < p.failed {
+		p.failed = tp.Offset
+	}
+}
+
+// inflight returns the number of registered messages of a partition which have not finished.
+func (t *offsetTracker) inflight(key partitionKey) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if p, ok := t.partitions[key]; ok {
+		return p.pending
+	}
+	return 0
+}
+
+// rewindable returns the failed offset of each partition which has no message in flight.
+func (t *offsetTracker) rewindable() []kafka.TopicPartition {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var out []kafka.TopicPartition
+	for key, p := range t.partitions {
+		if p.failed != kafka.OffsetInvalid && p.pending == 0 {
+			out = append(out, key.topicPartition(p.failed))
+		}
+	}
+	return out
+}
+
+// reset forgets the messages registered for a partition, keeping its committed offset.
+func (t *offsetTracker) reset(key partitionKey) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p, ok := t.partitions[key]
+	if !ok {
+		return
+	}
+
+	p.offsets = nil
+	clear(p.done)
+	p.pending = 0
+	p.next = kafka.OffsetInvalid
+	p.failed = kafka.OffsetInvalid
+}
+
+// remove drops all state of a partition, e.g. once it has been revoked.
+func (t *offsetTracker) remove(key partitionKey) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.partitions, key)
+}
+
+// committable returns the commit position of every partition which moved since its last commit.
+func (t *offsetTracker) committable() []kafka.TopicPartition {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var out []kafka.TopicPartition
+	for key, p := range t.partitions {
+		if p.next != kafka.OffsetInvalid && p.next > p.committed {
+			out = append(out, key.topicPartition(p.next))
+		}
+	}
+	return out
+}
+
+// committed records offsets which have been successfully committed.
+func (t *offsetTracker) committed(offsets []kafka.TopicPartition) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, tp := range offsets {
+		if tp.Error != nil {
+			continue
+		}
+		if p, ok := t.partitions[keyOf(tp)]; ok && tp.Offset > p.committed {
+			p.committed = tp.Offset
+		}
+	}
+}
+
+func (k partitionKey) topicPartition(offset kafka.Offset) kafka.TopicPartition {
+	topic := k.topic
+	return kafka.TopicPartition{Topic: &topic, Partition: k.partition, Offset: offset}
+}
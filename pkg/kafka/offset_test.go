@@ -0,0 +1,75 @@
+package kafka
+
+import (
+	"testing"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOffsetTracker(t *testing.T) {
+	topic := "movie.rating"
+	tp := func(partition int32, offset kafka.Offset) kafka.TopicPartition {
+		return kafka.TopicPartition{Topic: &topic, Partition: partition, Offset: offset}
+	}
+	key := partitionKey{topic: topic, partition: 0}
+
+	tracker := newOffsetTracker()
+	for offset := kafka.Offset(10); offset < 15; offset++ {
+		require.True(t, tracker.add(tp(0, offset)))
+	}
+	require.True(t, tracker.add(tp(1, 3)))
+	require.Equal(t, 5, tracker.inflight(key))
+	require.Empty(t, tracker.committable())
+
+	// out of order completions only commit the contiguous prefix
+	tracker.done(tp(0, 12))
+	tracker.done(tp(0, 11))
+	require.Empty(t, tracker.committable())
+
+	tracker.done(tp(0, 10))
+	require.Equal(t, []kafka.TopicPartition{tp(0, 13)}, tracker.committable())
+
+	tracker.committed([]kafka.TopicPartition{tp(0, 13)})
+	require.Empty(t, tracker.committable())
+
+	// a failure holds the partition at the failed offset and stops new registrations
+	tracker.fail(tp(0, 13))
+	require.False(t, tracker.add(tp(0, 15)))
+	require.Empty(t, tracker.rewindable())
+
+	tracker.done(tp(0, 14))
+	require.Empty(t, tracker.committable())
+	require.Equal(t, []kafka.TopicPartition{tp(0, 13)}, tracker.rewindable())
+
+	// once rewound the partition restarts from the failed offset
+	tracker.reset(key)
+	require.Empty(t, tracker.rewindable())
+	require.True(t, tracker.add(tp(0, 13)))
+	tracker.done(tp(0, 13))
+	require.Equal(t, []kafka.TopicPartition{tp(0, 14)}, tracker.committable())
+
+	tracker.done(tp(1, 3))
+	tracker.remove(key)
+	require.Equal(t, []kafka.TopicPartition{tp(1, 4)}, tracker.committable())
+}
+
+func TestOffsetTrackerSkip(t *testing.T) {
+	topic := "movie.rating"
+	tp := func(offset kafka.Offset) kafka.TopicPartition {
+		return kafka.TopicPartition{Topic: &topic, Offset: offset}
+	}
+
+	tracker := newOffsetTracker()
+	for _, offset := range []kafka.Offset{13, 14, 16} {
+		require.True(t, tracker.add(tp(offset)))
+	}
+	require.False(t, tracker.skip(tp(14)))
+
+	// messages registered after the failed one are released without being handled
+	tracker.fail(tp(13))
+	require.Empty(t, tracker.rewindable())
+	require.True(t, tracker.skip(tp(14)))
+	require.True(t, tracker.skip(tp(16)))
+	require.Equal(t, []kafka.TopicPartition{tp(13)}, tracker.rewindable())
+}
@@ -0,0 +1,104 @@
+package kafka
+
+import (
+	"context"
+	"hash/fnv"
+	"sync"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+)
+
+// OrderBy selects which messages must be handled one after another by the worker pool.
+type OrderBy string
+
+const (
+	// OrderByKey keeps messages with the same key in order. Messages without a key
+	// are ordered by partition.
+	OrderByKey OrderBy = "key"
+	// OrderByPartition keeps all messages of a partition in order.
+	OrderByPartition OrderBy = "partition"
+)
+
+const defaultInFlightPerWorker = 10
+
+// workerPool handles messages concurrently while routing all messages with the same
+// ordering key to the same worker.
+type workerPool struct {
+	orderBy OrderBy
+	queues  []chan *kafka.Message
+	slots   chan struct{}
+	wg      sync.WaitGroup
+}
+
+func newWorkerPool(concurrency, maxInFlight int, orderBy OrderBy) *workerPool {
+	if maxInFlight <= 0 {
+		maxInFlight = concurrency * defaultInFlightPerWorker
+	}
+	if orderBy == "" {
+		orderBy = OrderByKey
+	}
+
+	p := &workerPool{
+		orderBy: orderBy,
+		queues:  make([]chan *kafka.Message, concurrency),
+		slots:   make(chan struct{}, maxInFlight),
+	}
+	for i := range p.queues {
+		// a queue never holds more than maxInFlight messages, so submit only blocks on slots
+		p.queues[i] = make(chan *kafka.Message, maxInFlight)
+	}
+
+	return p
+}
+
+// start runs the workers. Messages still queued once ctx is done are handed over as
+// well, for handle to skip them.
+func (p *workerPool) start(ctx context.Context, handle func(context.Context, *kafka.Message)) {
+	for _, queue := range p.queues {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for msg := range queue {
+				handle(ctx, msg)
+				<-p.slots
+			}
+		}()
+	}
+}
+
+// submit queues msg for its worker, blocking while the in-flight limit is reached.
+// It returns false if ctx is done first.
+func (p *workerPool) submit(ctx context.Context, msg *kafka.Message) bool {
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return false
+	}
+
+	p.queues[p.worker(msg)] <- msg
+	return true
+}
+
+// stop waits for the workers to drain their queues. No message may be submitted afterwards.
+func (p *workerPool) stop() {
+	for _, queue := range p.queues {
+		close(queue)
+	}
+	p.wg.Wait()
+}
+
+func (p *workerPool) worker(msg *kafka.Message) int {
+	h := fnv.New32a()
+	if p.orderBy == OrderByKey && len(msg.Key) > 0 {
+		_, _ = h.Write(msg.Key)
+	} else {
+		_, _ = h.Write([]byte(*msg.TopicPartition.Topic))
+		_, _ = h.Write([]byte{
+			byte(msg.TopicPartition.Partition >> 24),
+			byte(msg.TopicPartition.Partition >> 16),
+			byte(msg.TopicPartition.Partition >> 8),
+			byte(msg.TopicPartition.Partition),
+		})
+	}
+	return int(h.Sum32() % uint32(len(p.queues)))
+}
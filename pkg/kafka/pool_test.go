@@ -0,0 +1,56 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPoolSkipsMessagesQueuedBehindFailure(t *testing.T) {
+	ctx := context.Background()
+	topic := "movie.rating"
+	newMsg := func(offset kafka.Offset) *kafka.Message {
+		return &kafka.Message{
+			TopicPartition: kafka.TopicPartition{Topic: &topic, Offset: offset},
+			Key:            []byte("movie_1"),
+		}
+	}
+
+	var mu sync.Mutex
+	var handled []kafka.Offset
+	release := make(chan struct{})
+	offsets := newOffsetTracker()
+	c := &Consumer{
+		offsets:   offsets,
+		committer: newCommitter(nil, CommitModeBatch, time.Hour, offsets, nil),
+		pool:      newWorkerPool(2, 0, OrderByKey),
+		messageHandler: func(_ context.Context, msg *kafka.Message) error {
+			mu.Lock()
+			handled = append(handled, msg.TopicPartition.Offset)
+			mu.Unlock()
+
+			if msg.TopicPartition.Offset == 13 {
+				<-release
+				return errors.New("failed")
+			}
+			return nil
+		},
+	}
+	c.pool.start(ctx, c.handleMessage)
+
+	// 14 and 16 are queued behind 13 before it fails
+	for _, offset := range []kafka.Offset{13, 14, 16} {
+		c.dispatch(ctx, newMsg(offset))
+	}
+	close(release)
+	c.pool.stop()
+
+	require.Equal(t, []kafka.Offset{13}, handled)
+	require.Zero(t, offsets.inflight(keyOf(newMsg(13).TopicPartition)))
+	require.Equal(t, []kafka.TopicPartition{newMsg(13).TopicPartition}, offsets.rewindable())
+}
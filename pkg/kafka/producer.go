@@ -2,11 +2,12 @@ package kafka
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 
 	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/google/uuid"
 	"github.com/vncats/otel-demo/pkg/kafka/tracing"
+	"github.com/vncats/otel-demo/pkg/otel/log"
 	"go.opentelemetry.io/otel"
 )
 
@@ -25,6 +26,17 @@ type ProducerOptions struct {
 	LingerMs        int
 
 	EnableTracing bool
+
+	// TransactionalID enables transactions, see Producer.Transaction. Transactions are
+	// initialized by NewProducer.
+	TransactionalID string
+
+	// Serializer encodes message values, JSONSerde by default.
+	Serializer Serializer
+
+	// OnDeliveryFailed is called with every message which could not be delivered,
+	// whether it was produced synchronously or not.
+	OnDeliveryFailed func(ctx context.Context, msg *kafka.Message, err error)
 }
 
 func (o ProducerOptions) KafkaConfig() kafka.ConfigMap {
@@ -39,6 +51,7 @@ func (o ProducerOptions) KafkaConfig() kafka.ConfigMap {
 	setKafkaConfig(cm, "batch.num.messages", o.BatchMessages)
 	setKafkaConfig(cm, "linger.ms", o.LingerMs)
 	setKafkaConfig(cm, "compression.type", o.CompressionType)
+	setKafkaConfig(cm, "transactional.id", o.TransactionalID)
 
 	return cm
 }
@@ -61,56 +74,153 @@ func WithTraceContext(ctx context.Context) MessageOption {
 	}
 }
 
+// WithMessageID replaces the generated ID of the message with id, so that a message
+// produced again, e.g. from an outbox, is recognised as a duplicate by consumers.
+func WithMessageID(id string) MessageOption {
+	return func(msg *kafka.Message) *kafka.Message {
+		tracing.NewMessageCarrier(msg).Set(HeaderMessageID, id)
+		return msg
+	}
+}
+
 type Producer struct {
-	client ProducerClient
+	client     ProducerClient
+	metrics    *tracing.ProducerMetrics
+	serializer Serializer
+	txn        transactionalClient
+
+	onDeliveryFailed func(ctx context.Context, msg *kafka.Message, err error)
 }
 
-func NewProducer(opts ProducerOptions) (*Producer, error) {
+func NewProducer(opts ProducerOptions) (_ *Producer, err error) {
 	kkConfig := opts.KafkaConfig()
 
 	c, err := kafka.NewProducer(&kkConfig)
 	if err != nil {
 		return nil, err
 	}
+	defer func() {
+		// the producer is only handed over once fully set up
+		if err != nil {
+			c.Close()
+		}
+	}()
+
+	if opts.Serializer == nil {
+		opts.Serializer = JSONSerde{}
+	}
+
+	if opts.OnDeliveryFailed == nil {
+		opts.OnDeliveryFailed = noopDeliveryFailed
+	}
+
+	wrapOpts := tracing.WrapOptions{
+		Attributes: tracing.GetKafkaAttrs(kkConfig),
+	}
 
 	var client ProducerClient = c
 	if opts.EnableTracing {
-		client = tracing.WrapProducer(c, tracing.WrapOptions{
-			Attributes: tracing.GetKafkaAttrs(kkConfig),
-		})
+		client, err = tracing.WrapProducer(c, wrapOpts)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	metrics, err := tracing.NewProducerMetrics(wrapOpts)
+	if err != nil {
+		return nil, err
 	}
 
 	producer := &Producer{
-		client: client,
+		client:           client,
+		metrics:          metrics,
+		serializer:       opts.Serializer,
+		onDeliveryFailed: opts.OnDeliveryFailed,
+	}
+
+	if opts.TransactionalID != "" {
+		producer.txn = client.(transactionalClient)
+
+		ctx, cancel := context.WithTimeout(context.Background(), defaultTransactionInitTimeout)
+		defer cancel()
+		if err = producer.txn.InitTransactions(ctx); err != nil {
+			return nil, fmt.Errorf("init transactions: %w", err)
+		}
 	}
 
 	return producer, nil
 }
 
 func (p *Producer) Produce(topic string, key string, value any, opts ...MessageOption) (*kafka.Message, error) {
-	valueBytes, err := json.Marshal(value)
+	msg, err := p.newMessage(topic, key, value)
 	if err != nil {
 		return nil, err
 	}
 
-	msg := &kafka.Message{
+	return p.ProduceMessage(msg, opts...)
+}
+
+// ProduceAsync enqueues a message without waiting for the broker. The returned Delivery
+// is resolved once the delivery report is received, which requires Start to be called.
+func (p *Producer) ProduceAsync(topic string, key string, value any, opts ...MessageOption) (*Delivery, error) {
+	msg, err := p.newMessage(topic, key, value)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.ProduceMessageAsync(msg, opts...)
+}
+
+// ProduceMessageAsync enqueues a prepared message as is, see ProduceAsync.
+func (p *Producer) ProduceMessageAsync(msg *kafka.Message, opts ...MessageOption) (*Delivery, error) {
+	for _, opt := range opts {
+		msg = opt(msg)
+	}
+
+	delivery := newDelivery()
+	msg.Opaque = delivery
+	if err := p.client.Produce(msg, nil); err != nil {
+		return nil, err
+	}
+
+	return delivery, nil
+}
+
+// newMessage serializes value and tags the message with its content type and a new ID,
+// which WithMessageID replaces.
+func (p *Producer) newMessage(topic string, key string, value any) (*kafka.Message, error) {
+	valueBytes, err := p.serializer.Serialize(topic, value)
+	if err != nil {
+		return nil, err
+	}
+
+	return &kafka.Message{
 		TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
 		Key:            []byte(key),
 		Value:          valueBytes,
-	}
+		Headers: []kafka.Header{
+			{Key: HeaderContentType, Value: []byte(p.serializer.ContentType())},
+			{Key: HeaderMessageID, Value: []byte(uuid.NewString())},
+		},
+	}, nil
+}
+
+// ProduceMessage sends a prepared message as is and waits for its delivery report.
+func (p *Producer) ProduceMessage(msg *kafka.Message, opts ...MessageOption) (*kafka.Message, error) {
 	for _, opt := range opts {
 		msg = opt(msg)
 	}
 
 	deliveryChan := make(chan kafka.Event)
-	if err = p.client.Produce(msg, deliveryChan); err != nil {
+	if err := p.client.Produce(msg, deliveryChan); err != nil {
 		return nil, err
 	}
 
 	ev := <-deliveryChan
 	if delivered, ok := ev.(*kafka.Message); ok {
+		p.handleDelivery(delivered)
 		if delivered.TopicPartition.Error != nil {
-			return nil, msg.TopicPartition.Error
+			return nil, delivered.TopicPartition.Error
 		}
 
 		return delivered, nil
@@ -119,23 +229,42 @@ func (p *Producer) Produce(topic string, key string, value any, opts ...MessageO
 	return nil, fmt.Errorf("unexpected event type: %T", ev)
 }
 
+// Start handles the events of the producer: delivery reports of asynchronously produced
+// messages and client errors.
 func (p *Producer) Start() {
-	// Handle events on default delivery channel
 	go func() {
 		for e := range p.client.Events() {
 			switch ev := e.(type) {
 			case *kafka.Message:
-				if ev.TopicPartition.Error != nil {
-					fmt.Printf("Delivery failed: %v\n", ev.TopicPartition)
-				} else {
-					fmt.Printf("Delivered message to %v\n", ev.TopicPartition)
+				p.handleDelivery(ev)
+				if delivery, ok := ev.Opaque.(*Delivery); ok {
+					delivery.resolve(ev, ev.TopicPartition.Error)
 				}
+			case kafka.Error:
+				log.Error(context.Background(), "producer error", "error", ev, "fatal", ev.IsFatal())
 			}
 		}
 	}()
 }
 
+// handleDelivery reports the delivery of msg through metrics, logs and, if it failed,
+// the OnDeliveryFailed callback.
+func (p *Producer) handleDelivery(msg *kafka.Message) {
+	ctx := tracing.ContextFromMessage(context.Background(), msg)
+	p.metrics.RecordDelivery(ctx, msg)
+
+	if err := msg.TopicPartition.Error; err != nil {
+		log.Error(ctx, "failed to deliver message", "error", err, "topic", *msg.TopicPartition.Topic)
+		p.onDeliveryFailed(ctx, msg, err)
+		return
+	}
+
+	log.Debug(ctx, "delivered message", "offset", msg.TopicPartition)
+}
+
 func (p *Producer) Stop() {
 	p.client.Flush(5000)
 	p.client.Close()
 }
+
+func noopDeliveryFailed(_ context.Context, _ *kafka.Message, _ error) {}
@@ -0,0 +1,114 @@
+package kafka
+
+import (
+	"context"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/vncats/otel-demo/pkg/kafka/tracing"
+	"github.com/vncats/otel-demo/pkg/otel/log"
+)
+
+// Values of partition.assignment.strategy.
+const (
+	AssignmentRange             = "range"
+	AssignmentRoundRobin        = "roundrobin"
+	AssignmentCooperativeSticky = "cooperative-sticky"
+)
+
+// RebalanceHook is notified of partitions assigned to or revoked from the consumer.
+type RebalanceHook func(ctx context.Context, partitions []kafka.TopicPartition) error
+
+const (
+	drainInterval      = 10 * time.Millisecond
+	committedTimeoutMs = 1000
+)
+
+// rebalance is the rebalance callback of the consumer, invoked by librdkafka from Poll,
+// or from Close once the poll loop stopped. Assignment itself is left to the client
+// library, which uses incremental assignment under the cooperative protocol.
+func (c *Consumer) rebalance(consumer *kafka.Consumer, ev kafka.Event) error {
+	ctx := c.loopContext()
+
+	switch e := ev.(type) {
+	case kafka.AssignedPartitions:
+		var duration time.Duration
+		if !c.rebalanceStart.IsZero() {
+			duration = time.Since(c.rebalanceStart)
+			c.rebalanceStart = time.Time{}
+		}
+		c.metrics.RecordRebalance(ctx, "assigned", duration)
+		c.fetchCommitted(ctx, consumer, e.Partitions)
+
+		c.runRebalanceHook(ctx, "assigned", e.Partitions, func(ctx context.Context) error {
+			log.Info(ctx, "partitions assigned",
+				"partitions", tracing.FormatPartitions(e.Partitions),
+				"protocol", consumer.GetRebalanceProtocol(),
+			)
+			return c.onAssigned(ctx, e.Partitions)
+		})
+	case kafka.RevokedPartitions:
+		c.rebalanceStart = time.Now()
+		c.metrics.RecordRebalance(ctx, "revoked", 0)
+
+		lost := consumer.AssignmentLost()
+		c.runRebalanceHook(ctx, "revoked", e.Partitions, func(ctx context.Context) error {
+			log.Info(ctx, "partitions revoked",
+				"partitions", tracing.FormatPartitions(e.Partitions),
+				"protocol", consumer.GetRebalanceProtocol(),
+				"lost", lost,
+			)
+			c.release(ctx, e.Partitions, lost)
+			return c.onRevoked(ctx, e.Partitions)
+		})
+		c.metrics.ForgetCommitted(e.Partitions)
+	}
+
+	return nil
+}
+
+// fetchCommitted fetches the committed offsets of newly assigned partitions once, from
+// which the lag metric is observed until the next commit.
+func (c *Consumer) fetchCommitted(ctx context.Context, consumer *kafka.Consumer, partitions []kafka.TopicPartition) {
+	committed, err := consumer.Committed(partitions, committedTimeoutMs)
+	if err != nil {
+		log.Warn(ctx, "failed to fetch committed offsets", "error", err)
+		return
+	}
+	c.metrics.RecordCommitted(committed)
+}
+
+func (c *Consumer) runRebalanceHook(ctx context.Context, rebalanceType string, partitions []kafka.TopicPartition, fn func(context.Context) error) {
+	end := func(error) {}
+	if c.tracer != nil {
+		ctx, end = c.tracer.StartRebalanceSpan(ctx, rebalanceType, partitions)
+	}
+
+	err := safeCall(func() error { return fn(ctx) })
+	end(err)
+	if err != nil {
+		log.Error(ctx, "failed to handle rebalance", "error", err, "type", rebalanceType)
+	}
+}
+
+// release finishes the work on revoked partitions before they are handed over: the pending
+// batch is handled, in-flight messages are waited for and handled offsets are committed,
+// unless the assignment was lost and commits would be rejected anyway.
+func (c *Consumer) release(ctx context.Context, partitions []kafka.TopicPartition, lost bool) {
+	if c.batcher != nil && len(c.batcher.msgs) > 0 && ctx.Err() == nil {
+		c.handleBatch(ctx, c.batcher.take())
+	}
+
+	for _, tp := range partitions {
+		for c.offsets.inflight(keyOf(tp)) > 0 && ctx.Err() == nil {
+			time.Sleep(drainInterval)
+		}
+	}
+
+	if !lost {
+		c.committer.flush(ctx)
+	}
+	for _, tp := range partitions {
+		c.offsets.remove(keyOf(tp))
+	}
+}
@@ -0,0 +1,368 @@
+package kafka
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/hamba/avro/v2"
+)
+
+// wireMagicByte prefixes every payload in the Confluent wire format, followed by the
+// 4-byte big-endian schema ID and the encoded value.
+const (
+	wireMagicByte  = 0
+	wireHeaderSize = 5
+)
+
+// Compatibility is the rule a new schema version must satisfy against the latest one.
+type Compatibility string
+
+const (
+	// CompatibilityNone accepts any new schema version.
+	CompatibilityNone Compatibility = "NONE"
+	// CompatibilityBackward requires consumers using the new schema to read data written with the latest one.
+	CompatibilityBackward Compatibility = "BACKWARD"
+	// CompatibilityForward requires consumers using the latest schema to read data written with the new one.
+	CompatibilityForward Compatibility = "FORWARD"
+	// CompatibilityFull requires both backward and forward compatibility.
+	CompatibilityFull Compatibility = "FULL"
+)
+
+var (
+	ErrSchemaNotFound     = errors.New("schema not found")
+	ErrIncompatibleSchema = errors.New("incompatible schema")
+)
+
+// Schema is a version of an Avro schema registered under a subject.
+type Schema struct {
+	ID      int    `json:"id"`
+	Subject string `json:"subject"`
+	Version int    `json:"version"`
+	Schema  string `json:"schema"`
+
+	parsed avro.Schema
+}
+
+// SchemaRegistry stores the schemas of message values by subject.
+type SchemaRegistry interface {
+	// Register adds schema as the latest version of subject and returns its ID. Registering
+	// a schema identical to an existing version of subject returns the existing ID.
+	Register(subject string, schema string) (int, error)
+	// SchemaByID returns the schema registered with id.
+	SchemaByID(id int) (*Schema, error)
+	// LatestSchema returns the latest version of subject.
+	LatestSchema(subject string) (*Schema, error)
+}
+
+// SubjectName returns the subject of the value schemas of topic, following the topic name strategy.
+func SubjectName(topic string) string {
+	return topic + "-value"
+}
+
+// EncodeWire prefixes payload with the magic byte and the schema ID of the Confluent wire format.
+func EncodeWire(schemaID int, payload []byte) []byte {
+	data := make([]byte, wireHeaderSize, wireHeaderSize+len(payload))
+	data[0] = wireMagicByte
+	binary.BigEndian.PutUint32(data[1:wireHeaderSize], uint32(schemaID))
+	return append(data, payload...)
+}
+
+// DecodeWire splits data in the Confluent wire format into its schema ID and payload.
+func DecodeWire(data []byte) (int, []byte, error) {
+	if len(data) < wireHeaderSize {
+		return 0, nil, fmt.Errorf("wire format: payload too short (%d bytes)", len(data))
+	}
+	if data[0] != wireMagicByte {
+		return 0, nil, fmt.Errorf("wire format: unknown magic byte %d", data[0])
+	}
+	return int(binary.BigEndian.Uint32(data[1:wireHeaderSize])), data[wireHeaderSize:], nil
+}
+
+// LocalRegistryOptions configures a LocalRegistry.
+type LocalRegistryOptions struct {
+	// Path of the file the registry is loaded from and saved to. Empty keeps schemas in memory only.
+	Path string
+	// Compatibility checked when registering a new version of a subject. Defaults to CompatibilityBackward.
+	Compatibility Compatibility
+}
+
+// LocalRegistry is an in-process SchemaRegistry, optionally backed by a JSON file.
+// It is meant for tests and local development.
+type LocalRegistry struct {
+	path          string
+	compatibility Compatibility
+
+	mu       sync.RWMutex
+	schemas  []*Schema
+	subjects map[string][]*Schema
+}
+
+var _ SchemaRegistry = (*LocalRegistry)(nil)
+
+// NewLocalRegistry creates a LocalRegistry, loading the schemas saved at opts.Path if it exists.
+func NewLocalRegistry(opts LocalRegistryOptions) (*LocalRegistry, error) {
+	if opts.Compatibility == "" {
+		opts.Compatibility = CompatibilityBackward
+	}
+
+	r := &LocalRegistry{
+		path:          opts.Path,
+		compatibility: opts.Compatibility,
+		subjects:      make(map[string][]*Schema),
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *LocalRegistry) Register(subject string, schema string) (int, error) {
+	parsed, err := parseSchema(schema)
+	if err != nil {
+		return 0, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	versions := r.subjects[subject]
+	for _, s := range versions {
+		if s.parsed.Fingerprint() == parsed.Fingerprint() {
+			return s.ID, nil
+		}
+	}
+	if len(versions) > 0 {
+		latest := versions[len(versions)-1]
+		if err := checkCompatibility(r.compatibility, parsed, latest.parsed); err != nil {
+			return 0, fmt.Errorf("%w: subject %s version %d: %v", ErrIncompatibleSchema, subject, latest.Version, err)
+		}
+	}
+
+	s := &Schema{
+		ID:      len(r.schemas) + 1,
+		Subject: subject,
+		Version: len(versions) + 1,
+		Schema:  schema,
+		parsed:  parsed,
+	}
+	r.schemas = append(r.schemas, s)
+	r.subjects[subject] = append(versions, s)
+
+	if err := r.save(); err != nil {
+		r.schemas = r.schemas[:len(r.schemas)-1]
+		r.subjects[subject] = versions
+		return 0, err
+	}
+
+	return s.ID, nil
+}
+
+func (r *LocalRegistry) SchemaByID(id int) (*Schema, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if id < 1 || id > len(r.schemas) {
+		return nil, fmt.Errorf("%w: id %d", ErrSchemaNotFound, id)
+	}
+	return r.schemas[id-1], nil
+}
+
+func (r *LocalRegistry) LatestSchema(subject string) (*Schema, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	versions := r.subjects[subject]
+	if len(versions) == 0 {
+		return nil, fmt.Errorf("%w: subject %s", ErrSchemaNotFound, subject)
+	}
+	return versions[len(versions)-1], nil
+}
+
+func (r *LocalRegistry) load() error {
+	if r.path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(r.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read schema registry: %w", err)
+	}
+
+	var schemas []*Schema
+	if err := json.Unmarshal(data, &schemas); err != nil {
+		return fmt.Errorf("decode schema registry: %w", err)
+	}
+	for i, s := range schemas {
+		if s.ID != i+1 {
+			return fmt.Errorf("decode schema registry: unexpected schema id %d at position %d", s.ID, i)
+		}
+		if s.parsed, err = parseSchema(s.Schema); err != nil {
+			return err
+		}
+		r.schemas = append(r.schemas, s)
+		r.subjects[s.Subject] = append(r.subjects[s.Subject], s)
+	}
+
+	return nil
+}
+
+func (r *LocalRegistry) save() error {
+	if r.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(r.schemas, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode schema registry: %w", err)
+	}
+	if err := os.WriteFile(r.path, data, 0o644); err != nil {
+		return fmt.Errorf("write schema registry: %w", err)
+	}
+
+	return nil
+}
+
+// parseSchema parses schema with its own cache, so that different versions of a named
+// type do not clash with each other.
+func parseSchema(schema string) (avro.Schema, error) {
+	parsed, err := avro.ParseWithCache(schema, "", &avro.SchemaCache{})
+	if err != nil {
+		return nil, fmt.Errorf("parse schema: %w", err)
+	}
+	return parsed, nil
+}
+
+func checkCompatibility(compatibility Compatibility, schema, latest avro.Schema) error {
+	sc := avro.NewSchemaCompatibility()
+
+	switch compatibility {
+	case CompatibilityNone:
+		return nil
+	case CompatibilityBackward:
+		return sc.Compatible(schema, latest)
+	case CompatibilityForward:
+		return sc.Compatible(latest, schema)
+	case CompatibilityFull:
+		return errors.Join(sc.Compatible(schema, latest), sc.Compatible(latest, schema))
+	default:
+		return fmt.Errorf("unknown compatibility %q", compatibility)
+	}
+}
+
+// RegistrySerde encodes values with an Avro schema registered in a SchemaRegistry, in the
+// Confluent wire format. The schema is registered under the subject of each topic the
+// first time a value is serialized for it, failing if it is incompatible with the latest
+// version. Values are decoded with the schema they were written with, resolved against
+// the schema of the serde.
+type RegistrySerde struct {
+	registry SchemaRegistry
+	schema   string
+	parsed   avro.Schema
+
+	mu       sync.Mutex
+	ids      map[string]int
+	resolved map[int]avro.Schema
+}
+
+var _ Serde = (*RegistrySerde)(nil)
+
+// NewRegistrySerde creates a RegistrySerde encoding and decoding values with schema.
+func NewRegistrySerde(registry SchemaRegistry, schema string) (*RegistrySerde, error) {
+	parsed, err := parseSchema(schema)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RegistrySerde{
+		registry: registry,
+		schema:   schema,
+		parsed:   parsed,
+		ids:      make(map[string]int),
+		resolved: make(map[int]avro.Schema),
+	}, nil
+}
+
+func (s *RegistrySerde) ContentType() string {
+	return ContentTypeAvro
+}
+
+func (s *RegistrySerde) Serialize(topic string, v any) ([]byte, error) {
+	id, err := s.schemaID(topic)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := avro.Marshal(s.parsed, v)
+	if err != nil {
+		return nil, err
+	}
+
+	return EncodeWire(id, payload), nil
+}
+
+func (s *RegistrySerde) Deserialize(_ string, data []byte, v any) error {
+	id, payload, err := DecodeWire(data)
+	if err != nil {
+		return err
+	}
+
+	schema, err := s.readerSchema(id)
+	if err != nil {
+		return err
+	}
+
+	return avro.Unmarshal(schema, payload, v)
+}
+
+func (s *RegistrySerde) schemaID(topic string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if id, ok := s.ids[topic]; ok {
+		return id, nil
+	}
+
+	id, err := s.registry.Register(SubjectName(topic), s.schema)
+	if err != nil {
+		return 0, err
+	}
+	s.ids[topic] = id
+
+	return id, nil
+}
+
+// readerSchema returns the schema decoding data written with the schema id into values
+// of the serde's schema.
+func (s *RegistrySerde) readerSchema(id int) (avro.Schema, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if schema, ok := s.resolved[id]; ok {
+		return schema, nil
+	}
+
+	writer, err := s.registry.SchemaByID(id)
+	if err != nil {
+		return nil, err
+	}
+	// registries only return the text of the schema, which is parsed once per id
+	writerSchema, err := parseSchema(writer.Schema)
+	if err != nil {
+		return nil, err
+	}
+	schema, err := avro.NewSchemaCompatibility().Resolve(s.parsed, writerSchema)
+	if err != nil {
+		return nil, fmt.Errorf("%w: schema id %d: %v", ErrIncompatibleSchema, id, err)
+	}
+	s.resolved[id] = schema
+
+	return schema, nil
+}
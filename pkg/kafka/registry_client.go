@@ -0,0 +1,159 @@
+package kafka
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+const (
+	registryContentType    = "application/vnd.schemaregistry.v1+json"
+	defaultRegistryTimeout = 10 * time.Second
+)
+
+// RegistryClientOptions configures a RegistryClient.
+type RegistryClientOptions struct {
+	// URL of the registry, e.g. http://localhost:8081.
+	URL string
+	// Username and Password authenticate with basic auth when Username is set.
+	Username string
+	Password string
+	// HTTPClient sends the requests, a traced client timing out after 10 seconds by default.
+	HTTPClient *http.Client
+}
+
+// RegistryClient is a SchemaRegistry backed by a Confluent Schema Registry over its REST
+// API. Compatibility is checked by the registry according to the configuration of each
+// subject. Schemas are immutable, so those fetched by ID are cached.
+type RegistryClient struct {
+	url      string
+	username string
+	password string
+	client   *http.Client
+
+	mu      sync.RWMutex
+	schemas map[int]*Schema
+}
+
+var _ SchemaRegistry = (*RegistryClient)(nil)
+
+// registryError is the body of the error responses of the registry.
+type registryError struct {
+	ErrorCode int    `json:"error_code"`
+	Message   string `json:"message"`
+}
+
+func NewRegistryClient(opts RegistryClientOptions) *RegistryClient {
+	if opts.HTTPClient == nil {
+		opts.HTTPClient = &http.Client{
+			Timeout:   defaultRegistryTimeout,
+			Transport: otelhttp.NewTransport(http.DefaultTransport),
+		}
+	}
+
+	return &RegistryClient{
+		url:      strings.TrimSuffix(opts.URL, "/"),
+		username: opts.Username,
+		password: opts.Password,
+		client:   opts.HTTPClient,
+		schemas:  make(map[int]*Schema),
+	}
+}
+
+func (r *RegistryClient) Register(subject string, schema string) (int, error) {
+	var resp struct {
+		ID int `json:"id"`
+	}
+	path := "/subjects/" + url.PathEscape(subject) + "/versions"
+	if err := r.do(http.MethodPost, path, map[string]string{"schema": schema}, &resp); err != nil {
+		return 0, fmt.Errorf("register schema for subject %s: %w", subject, err)
+	}
+
+	return resp.ID, nil
+}
+
+func (r *RegistryClient) SchemaByID(id int) (*Schema, error) {
+	r.mu.RLock()
+	s, ok := r.schemas[id]
+	r.mu.RUnlock()
+	if ok {
+		return s, nil
+	}
+
+	s = &Schema{ID: id}
+	if err := r.do(http.MethodGet, fmt.Sprintf("/schemas/ids/%d", id), nil, s); err != nil {
+		return nil, fmt.Errorf("get schema id %d: %w", id, err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.schemas[id] = s
+
+	return s, nil
+}
+
+func (r *RegistryClient) LatestSchema(subject string) (*Schema, error) {
+	var s Schema
+	path := "/subjects/" + url.PathEscape(subject) + "/versions/latest"
+	if err := r.do(http.MethodGet, path, nil, &s); err != nil {
+		return nil, fmt.Errorf("get latest schema of subject %s: %w", subject, err)
+	}
+
+	return &s, nil
+}
+
+// do sends a request with body encoded in JSON and decodes the response into out. Error
+// responses are mapped to ErrSchemaNotFound and ErrIncompatibleSchema when they apply.
+func (r *RegistryClient) do(method string, path string, body any, out any) error {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(context.Background(), method, r.url+path, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", registryContentType)
+	if body != nil {
+		req.Header.Set("Content-Type", registryContentType)
+	}
+	if r.username != "" {
+		req.SetBasicAuth(r.username, r.password)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		var regErr registryError
+		_ = json.NewDecoder(resp.Body).Decode(&regErr)
+
+		switch resp.StatusCode {
+		case http.StatusNotFound:
+			return fmt.Errorf("%w: %s", ErrSchemaNotFound, regErr.Message)
+		case http.StatusConflict:
+			return fmt.Errorf("%w: %s", ErrIncompatibleSchema, regErr.Message)
+		default:
+			return fmt.Errorf("registry responded %d (error code %d): %s", resp.StatusCode, regErr.ErrorCode, regErr.Message)
+		}
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
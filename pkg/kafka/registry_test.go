@@ -0,0 +1,197 @@
+package kafka
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const ratingSchemaV1 = `{
+	"type": "record",
+	"name": "Rating",
+	"fields": [
+		{"name": "movie_id", "type": "int"},
+		{"name": "uid", "type": "string"},
+		{"name": "score", "type": "int"}
+	]
+}`
+
+// ratingSchemaV2 adds a field with a default, which is backward compatible.
+const ratingSchemaV2 = `{
+	"type": "record",
+	"name": "Rating",
+	"fields": [
+		{"name": "movie_id", "type": "int"},
+		{"name": "uid", "type": "string"},
+		{"name": "score", "type": "int"},
+		{"name": "comment", "type": "string", "default": ""}
+	]
+}`
+
+// ratingSchemaV3 adds a field without default, which is not backward compatible.
+const ratingSchemaV3 = `{
+	"type": "record",
+	"name": "Rating",
+	"fields": [
+		{"name": "movie_id", "type": "int"},
+		{"name": "uid", "type": "string"},
+		{"name": "score", "type": "int"},
+		{"name": "source", "type": "string"}
+	]
+}`
+
+func TestWireFormat(t *testing.T) {
+	data := EncodeWire(42, []byte("payload"))
+	require.Equal(t, []byte{0, 0, 0, 0, 42}, data[:5])
+
+	id, payload, err := DecodeWire(data)
+	require.NoError(t, err)
+	require.Equal(t, 42, id)
+	require.Equal(t, []byte("payload"), payload)
+
+	_, _, err = DecodeWire([]byte{1, 0, 0, 0, 42})
+	require.Error(t, err)
+	_, _, err = DecodeWire([]byte{0, 0})
+	require.Error(t, err)
+}
+
+func TestLocalRegistry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "schemas.json")
+	subject := SubjectName("movie.rating")
+
+	registry, err := NewLocalRegistry(LocalRegistryOptions{Path: path})
+	require.NoError(t, err)
+
+	id1, err := registry.Register(subject, ratingSchemaV1)
+	require.NoError(t, err)
+	id, err := registry.Register(subject, ratingSchemaV1)
+	require.NoError(t, err)
+	require.Equal(t, id1, id)
+
+	id2, err := registry.Register(subject, ratingSchemaV2)
+	require.NoError(t, err)
+	require.NotEqual(t, id1, id2)
+
+	_, err = registry.Register(subject, ratingSchemaV3)
+	require.ErrorIs(t, err, ErrIncompatibleSchema)
+
+	forward, err := NewLocalRegistry(LocalRegistryOptions{Compatibility: CompatibilityForward})
+	require.NoError(t, err)
+	_, err = forward.Register(subject, ratingSchemaV1)
+	require.NoError(t, err)
+	_, err = forward.Register(subject, ratingSchemaV3)
+	require.NoError(t, err)
+
+	// the registry is restored from its file
+	registry, err = NewLocalRegistry(LocalRegistryOptions{Path: path})
+	require.NoError(t, err)
+	latest, err := registry.LatestSchema(subject)
+	require.NoError(t, err)
+	require.Equal(t, id2, latest.ID)
+	require.Equal(t, 2, latest.Version)
+
+	_, err = registry.SchemaByID(3)
+	require.ErrorIs(t, err, ErrSchemaNotFound)
+}
+
+func TestRegistrySerde(t *testing.T) {
+	topic := "movie.rating"
+	registry, err := NewLocalRegistry(LocalRegistryOptions{})
+	require.NoError(t, err)
+
+	v1, err := NewRegistrySerde(registry, ratingSchemaV1)
+	require.NoError(t, err)
+	v2, err := NewRegistrySerde(registry, ratingSchemaV2)
+	require.NoError(t, err)
+
+	want := rating{MovieID: 1, UID: "user_1", Score: 5}
+	data, err := v1.Serialize(topic, want)
+	require.NoError(t, err)
+
+	// a consumer on the new schema reads values written with the old one
+	var got struct {
+		rating
+		Comment string `avro:"comment"`
+	}
+	require.NoError(t, v2.Deserialize(topic, data, &got))
+	require.Equal(t, want, got.rating)
+	require.Empty(t, got.Comment)
+}
+
+func TestRegistryClient(t *testing.T) {
+	// the fake registry serves a LocalRegistry over the REST API of the schema registry
+	local, err := NewLocalRegistry(LocalRegistryOptions{})
+	require.NoError(t, err)
+	respond := func(w http.ResponseWriter, v any, err error) {
+		w.Header().Set("Content-Type", registryContentType)
+		switch {
+		case errors.Is(err, ErrSchemaNotFound):
+			w.WriteHeader(http.StatusNotFound)
+			v = registryError{ErrorCode: 40403, Message: err.Error()}
+		case errors.Is(err, ErrIncompatibleSchema):
+			w.WriteHeader(http.StatusConflict)
+			v = registryError{ErrorCode: 409, Message: err.Error()}
+		}
+		_ = json.NewEncoder(w).Encode(v)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /subjects/{subject}/versions", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Schema string `json:"schema"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		id, err := local.Register(r.PathValue("subject"), req.Schema)
+		respond(w, map[string]int{"id": id}, err)
+	})
+	mux.HandleFunc("GET /schemas/ids/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, _ := strconv.Atoi(r.PathValue("id"))
+		s, err := local.SchemaByID(id)
+		if err != nil {
+			respond(w, nil, err)
+			return
+		}
+		respond(w, map[string]string{"schema": s.Schema}, nil)
+	})
+	mux.HandleFunc("GET /subjects/{subject}/versions/latest", func(w http.ResponseWriter, r *http.Request) {
+		s, err := local.LatestSchema(r.PathValue("subject"))
+		respond(w, s, err)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	registry := NewRegistryClient(RegistryClientOptions{URL: server.URL})
+	subject := SubjectName("movie.rating")
+
+	_, err = registry.LatestSchema(subject)
+	require.ErrorIs(t, err, ErrSchemaNotFound)
+
+	id, err := registry.Register(subject, ratingSchemaV1)
+	require.NoError(t, err)
+	_, err = registry.Register(subject, ratingSchemaV3)
+	require.ErrorIs(t, err, ErrIncompatibleSchema)
+
+	latest, err := registry.LatestSchema(subject)
+	require.NoError(t, err)
+	require.Equal(t, id, latest.ID)
+	require.Equal(t, 1, latest.Version)
+
+	// values are decoded with the schema fetched from the registry
+	v1, err := NewRegistrySerde(registry, ratingSchemaV1)
+	require.NoError(t, err)
+	v2, err := NewRegistrySerde(registry, ratingSchemaV2)
+	require.NoError(t, err)
+
+	want := rating{MovieID: 1, UID: "user_1", Score: 5}
+	data, err := v1.Serialize("movie.rating", want)
+	require.NoError(t, err)
+	var got rating
+	require.NoError(t, v2.Deserialize("movie.rating", data, &got))
+	require.Equal(t, want, got)
+}
@@ -0,0 +1,148 @@
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/hamba/avro/v2"
+	"google.golang.org/protobuf/proto"
+)
+
+// HeaderContentType is set on every produced message to the content type of its serializer.
+const HeaderContentType = "content-type"
+
+// Content types of the built-in serializers.
+const (
+	ContentTypeJSON     = "application/json"
+	ContentTypeProtobuf = "application/x-protobuf"
+	ContentTypeAvro     = "application/avro"
+)
+
+// Serializer encodes message values for a topic.
+type Serializer interface {
+	ContentType() string
+	Serialize(topic string, v any) ([]byte, error)
+}
+
+// Deserializer decodes message values of a topic into v, which must be a pointer.
+type Deserializer interface {
+	Deserialize(topic string, data []byte, v any) error
+}
+
+// Serde is both a Serializer and a Deserializer.
+type Serde interface {
+	Serializer
+	Deserializer
+}
+
+var (
+	_ Serde = JSONSerde{}
+	_ Serde = ProtobufSerde{}
+	_ Serde = (*AvroSerde)(nil)
+)
+
+// JSONSerde encodes values with encoding/json. It is the default serde.
+type JSONSerde struct{}
+
+func (JSONSerde) ContentType() string {
+	return ContentTypeJSON
+}
+
+func (JSONSerde) Serialize(_ string, v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONSerde) Deserialize(_ string, data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
+
+// ProtobufSerde encodes values implementing proto.Message in the protobuf wire format.
+type ProtobufSerde struct{}
+
+func (ProtobufSerde) ContentType() string {
+	return ContentTypeProtobuf
+}
+
+func (ProtobufSerde) Serialize(_ string, v any) ([]byte, error) {
+	msg, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("protobuf: %T does not implement proto.Message", v)
+	}
+	return proto.Marshal(msg)
+}
+
+// Deserialize accepts either a proto.Message or a pointer to one, which is allocated if nil.
+func (ProtobufSerde) Deserialize(_ string, data []byte, v any) error {
+	msg, ok := v.(proto.Message)
+	if !ok {
+		rv := reflect.ValueOf(v)
+		if rv.Kind() != reflect.Pointer || rv.Elem().Kind() != reflect.Pointer {
+			return fmt.Errorf("protobuf: %T does not implement proto.Message", v)
+		}
+		if rv.Elem().IsNil() {
+			rv.Elem().Set(reflect.New(rv.Elem().Type().Elem()))
+		}
+		if msg, ok = rv.Elem().Interface().(proto.Message); !ok {
+			return fmt.Errorf("protobuf: %T does not implement proto.Message", v)
+		}
+	}
+	return proto.Unmarshal(data, msg)
+}
+
+// AvroSerde encodes values in Avro binary encoding with a fixed schema.
+type AvroSerde struct {
+	schema avro.Schema
+}
+
+// NewAvroSerde parses the Avro schema used to encode and decode values.
+func NewAvroSerde(schema string) (*AvroSerde, error) {
+	s, err := avro.Parse(schema)
+	if err != nil {
+		return nil, err
+	}
+	return &AvroSerde{schema: s}, nil
+}
+
+func (s *AvroSerde) ContentType() string {
+	return ContentTypeAvro
+}
+
+func (s *AvroSerde) Serialize(_ string, v any) ([]byte, error) {
+	return avro.Marshal(s.schema, v)
+}
+
+func (s *AvroSerde) Deserialize(_ string, data []byte, v any) error {
+	return avro.Unmarshal(s.schema, data, v)
+}
+
+// Produce serializes value with the serializer of p and waits for its delivery.
+// Unlike Producer.Produce, the value type is checked at compile time.
+func Produce[T any](p *Producer, topic string, key string, value T, opts ...MessageOption) (*kafka.Message, error) {
+	return p.Produce(topic, key, value, opts...)
+}
+
+// ProduceAsync serializes value with the serializer of p without waiting for its delivery.
+func ProduceAsync[T any](p *Producer, topic string, key string, value T, opts ...MessageOption) (*Delivery, error) {
+	return p.ProduceAsync(topic, key, value, opts...)
+}
+
+// Decode deserializes the value of msg into a T.
+func Decode[T any](d Deserializer, msg *kafka.Message) (T, error) {
+	var value T
+	err := d.Deserialize(*msg.TopicPartition.Topic, msg.Value, &value)
+	return value, err
+}
+
+// TypedHandler adapts fn into a MessageHandler which decodes each message value with d.
+func TypedHandler[T any](d Deserializer, fn func(ctx context.Context, msg *kafka.Message, value T) error) MessageHandler {
+	return func(ctx context.Context, msg *kafka.Message) error {
+		value, err := Decode[T](d, msg)
+		if err != nil {
+			return fmt.Errorf("decode message value: %w", err)
+		}
+		return fn(ctx, msg, value)
+	}
+}
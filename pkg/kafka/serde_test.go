@@ -0,0 +1,54 @@
+package kafka
+
+import (
+	"testing"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+type rating struct {
+	MovieID int    `json:"movie_id" avro:"movie_id"`
+	UID     string `json:"uid" avro:"uid"`
+	Score   int    `json:"score" avro:"score"`
+}
+
+func TestSerdes(t *testing.T) {
+	topic := "movie.rating"
+	newMsg := func(s Serializer, v any) *kafka.Message {
+		data, err := s.Serialize(topic, v)
+		require.NoError(t, err)
+		return &kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &topic}, Value: data}
+	}
+
+	want := rating{MovieID: 1, UID: "user_1", Score: 5}
+
+	msg := newMsg(JSONSerde{}, want)
+	got, err := Decode[rating](JSONSerde{}, msg)
+	require.NoError(t, err)
+	require.Equal(t, want, got)
+
+	avroSerde, err := NewAvroSerde(`{
+		"type": "record",
+		"name": "Rating",
+		"fields": [
+			{"name": "movie_id", "type": "int"},
+			{"name": "uid", "type": "string"},
+			{"name": "score", "type": "int"}
+		]
+	}`)
+	require.NoError(t, err)
+	msg = newMsg(avroSerde, want)
+	got, err = Decode[rating](avroSerde, msg)
+	require.NoError(t, err)
+	require.Equal(t, want, got)
+
+	msg = newMsg(ProtobufSerde{}, wrapperspb.String("hello"))
+	value, err := Decode[*wrapperspb.StringValue](ProtobufSerde{}, msg)
+	require.NoError(t, err)
+	require.Equal(t, "hello", value.GetValue())
+
+	_, err = ProtobufSerde{}.Serialize(topic, want)
+	require.Error(t, err)
+}
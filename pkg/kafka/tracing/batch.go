@@ -0,0 +1,62 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// StartBatchSpan starts a span for processing a batch of messages. Since the messages
+// may belong to different traces, the span is linked to the producer span context of
+// each of them instead of being parented by one. The returned function ends the span, recording err
+// and the processing duration.
+func (c *Consumer) StartBatchSpan(ctx context.Context, msgs []*kafka.Message) (context.Context, func(err error)) {
+	links := make([]trace.Link, 0, len(msgs))
+	topics := make([]string, 0, 1)
+	for _, msg := range msgs {
+		msgCtx := ProducerContextFromMessage(context.Background(), msg)
+		if sc := trace.SpanContextFromContext(msgCtx); sc.IsValid() {
+			links = append(links, trace.Link{
+				SpanContext: sc,
+				Attributes: []attribute.KeyValue{
+					semconv.MessagingKafkaMessageOffset(int(msg.TopicPartition.Offset)),
+				},
+			})
+		}
+		if topic := *msg.TopicPartition.Topic; !slices.Contains(topics, topic) {
+			topics = append(topics, topic)
+		}
+	}
+
+	operationName := "process"
+	attrs := slices.Concat(c.attributes, []attribute.KeyValue{
+		semconv.MessagingOperationTypeDeliver,
+		semconv.MessagingSystemKafka,
+		semconv.MessagingBatchMessageCount(len(msgs)),
+	})
+	if len(topics) == 1 {
+		operationName = fmt.Sprintf("process %s", topics[0])
+		attrs = append(attrs, semconv.MessagingDestinationName(topics[0]))
+	}
+	attrs = append(attrs, semconv.MessagingOperationName(operationName))
+
+	startTime := time.Now()
+	spanCtx, span := tracer.Start(
+		ctx,
+		operationName,
+		trace.WithTimestamp(startTime),
+		trace.WithAttributes(attrs...),
+		trace.WithLinks(links...),
+		trace.WithSpanKind(trace.SpanKindConsumer),
+	)
+
+	return spanCtx, func(err error) {
+		c.endSpan(spanCtx, span, startTime, attrs, err)
+	}
+}
@@ -3,11 +3,13 @@ package tracing
 import (
 	"context"
 	"fmt"
+	"slices"
 	"strconv"
 	"time"
 
 	"github.com/vncats/otel-demo/pkg/otel/sdk"
 
+	"go.opentelemetry.io/otel/codes"
 	"go.opentelemetry.io/otel/metric"
 
 	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
@@ -34,71 +36,112 @@ type Consumer struct {
 
 	attributes        []attribute.KeyValue
 	durationHistogram metric.Float64Histogram
-
-	endPrevSpanFn func()
 }
 
+// Poll calls the underlying Consumer.Poll and traces the receipt of a message with a
+// span starting once the message was received and ending with EndReceiveSpan, once the
+// message was handled. The span context is injected into the message headers, so that it
+// becomes the parent of the process span, and the one of the producer is kept for
+// ProducerContextFromMessage.
 func (c *Consumer) Poll(timeoutMs int) (event kafka.Event) {
-	c.endPrevSpan()
-
 	evt := c.Consumer.Poll(timeoutMs)
 	if msg, ok := evt.(*kafka.Message); ok {
-		c.startSpan(msg)
+		c.traceReceive(msg)
 	}
 
 	return evt
 }
 
-func (c *Consumer) Close() error {
-	err := c.Consumer.Close()
-	c.endPrevSpan()
+// receiveSpan is kept in the Opaque field of a received message until EndReceiveSpan.
+type receiveSpan struct {
+	span trace.Span
+}
+
+// EndReceiveSpan ends the receive span of msg, recording err, once msg was handled or
+// given up. It does nothing if msg has no receive span or it already ended.
+func EndReceiveSpan(msg *kafka.Message, err error) {
+	rs, ok := msg.Opaque.(*receiveSpan)
+	if !ok {
+		return
+	}
+	msg.Opaque = nil
 
-	return err
+	if err != nil {
+		rs.span.RecordError(err)
+		rs.span.SetStatus(codes.Error, err.Error())
+	}
+	rs.span.End()
 }
 
-func (c *Consumer) startSpan(msg *kafka.Message) {
+// StartProcessSpan starts the span for handling msg as a child of the receive span.
+// The returned function ends the span once handling finished, recording err and the
+// processing duration.
+func (c *Consumer) StartProcessSpan(ctx context.Context, msg *kafka.Message) (context.Context, func(err error)) {
+	operationName := fmt.Sprintf("process %s", *msg.TopicPartition.Topic)
+	attrs := slices.Concat(c.attributes, []attribute.KeyValue{
+		semconv.MessagingOperationName(operationName),
+		semconv.MessagingOperationTypeDeliver,
+		semconv.MessagingSystemKafka,
+		semconv.MessagingDestinationName(*msg.TopicPartition.Topic),
+	})
+
+	startTime := time.Now()
+	spanCtx, span := tracer.Start(
+		ContextFromMessage(ctx, msg),
+		operationName,
+		trace.WithTimestamp(startTime),
+		trace.WithAttributes(slices.Concat(attrs, messageAttrs(msg))...),
+		trace.WithSpanKind(trace.SpanKindConsumer),
+	)
+
+	return spanCtx, func(err error) {
+		c.endSpan(spanCtx, span, startTime, attrs, err)
+	}
+}
+
+func (c *Consumer) traceReceive(msg *kafka.Message) {
 	carrier := NewMessageCarrier(msg)
 	parentCtx := propagator.Extract(context.Background(), carrier)
 
 	operationName := fmt.Sprintf("receive %s", *msg.TopicPartition.Topic)
 
-	attrs := append(
-		c.attributes,
+	attrs := slices.Concat(c.attributes, []attribute.KeyValue{
 		semconv.MessagingOperationName(operationName),
 		semconv.MessagingOperationTypeReceive,
 		semconv.MessagingSystemKafka,
 		semconv.MessagingDestinationName(*msg.TopicPartition.Topic),
-	)
-
-	spanAttrs := append(
-		attrs,
-		semconv.MessagingKafkaMessageOffset(int(msg.TopicPartition.Offset)),
-		semconv.MessagingKafkaMessageKey(string(msg.Key)),
-		semconv.MessagingMessageID(strconv.FormatInt(int64(msg.TopicPartition.Offset), 10)),
-		semconv.MessagingDestinationPartitionID(strconv.Itoa(int(msg.TopicPartition.Partition))),
-		semconv.MessagingMessageBodySize(getMsgSize(msg)),
-	)
+	}, messageAttrs(msg))
 
-	startTime := time.Now()
 	spanCtx, span := tracer.Start(
 		parentCtx,
 		operationName,
-		trace.WithTimestamp(startTime),
-		trace.WithAttributes(spanAttrs...),
+		trace.WithAttributes(attrs...),
 		trace.WithSpanKind(trace.SpanKindConsumer),
 	)
+	propagator.Inject(parentCtx, prefixedCarrier{MessageCarrier: carrier, prefix: producerHeaderPrefix})
 	propagator.Inject(spanCtx, carrier)
+	msg.Opaque = &receiveSpan{span: span}
+}
 
-	c.endPrevSpanFn = func() {
-		c.recordMetrics(spanCtx, startTime, metric.WithAttributes(attrs...))
-		span.End()
+// endSpan records err on the span and the processing duration, tagged with error.type.
+func (c *Consumer) endSpan(ctx context.Context, span trace.Span, startTime time.Time, attrs []attribute.KeyValue, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		attrs = append(slices.Clip(attrs), semconv.ErrorTypeKey.String(ErrorType(err)))
 	}
+
+	c.recordMetrics(ctx, startTime, metric.WithAttributes(attrs...))
+	span.End()
 }
 
-func (c *Consumer) endPrevSpan() {
-	if c.endPrevSpanFn != nil {
-		c.endPrevSpanFn()
-		c.endPrevSpanFn = nil
+func messageAttrs(msg *kafka.Message) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		semconv.MessagingKafkaMessageOffset(int(msg.TopicPartition.Offset)),
+		semconv.MessagingKafkaMessageKey(string(msg.Key)),
+		semconv.MessagingMessageID(strconv.FormatInt(int64(msg.TopicPartition.Offset), 10)),
+		semconv.MessagingDestinationPartitionID(strconv.Itoa(int(msg.TopicPartition.Partition))),
+		semconv.MessagingMessageBodySize(getMsgSize(msg)),
 	}
 }
 
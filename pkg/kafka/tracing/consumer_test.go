@@ -0,0 +1,41 @@
+package tracing
+
+import (
+	"context"
+	"testing"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestReceiveSpanEndsWithHandling(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	c := &Consumer{}
+	require.NoError(t, c.createMetrics())
+
+	topic := "movie.rating"
+	msg := &kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &topic}}
+	c.traceReceive(msg)
+	require.Empty(t, recorder.Ended())
+
+	_, end := c.StartProcessSpan(context.Background(), msg)
+	end(nil)
+	EndReceiveSpan(msg, nil)
+	// ending twice is a no-op
+	EndReceiveSpan(msg, nil)
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 2)
+	process, receive := spans[0], spans[1]
+	require.Equal(t, "process movie.rating", process.Name())
+	require.Equal(t, "receive movie.rating", receive.Name())
+	require.Equal(t, receive.SpanContext().SpanID(), process.Parent().SpanID())
+	require.False(t, receive.EndTime().Before(process.EndTime()))
+}
@@ -0,0 +1,96 @@
+package tracing
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/vncats/otel-demo/pkg/otel/sdk"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	handlerMessagesName = "messaging.kafka.handler.messages"
+	handlerDurationName = "messaging.kafka.handler.duration"
+)
+
+var handlerNameKey = attribute.Key("messaging.kafka.handler.name")
+
+// StartHandlerSpan starts an internal span named name for a handler of msg, as a child of
+// the span in ctx. The returned function ends the span, recording err.
+func StartHandlerSpan(ctx context.Context, name string, msg *kafka.Message) (context.Context, func(err error)) {
+	spanCtx, span := tracer.Start(ctx, name,
+		trace.WithAttributes(slices.Concat([]attribute.KeyValue{
+			semconv.MessagingSystemKafka,
+			semconv.MessagingDestinationName(*msg.TopicPartition.Topic),
+		}, messageAttrs(msg))...),
+		trace.WithSpanKind(trace.SpanKindInternal),
+	)
+
+	return spanCtx, func(err error) {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+}
+
+// HandlerMetrics records the messages handled by a named handler and how long they took.
+type HandlerMetrics struct {
+	attributes []attribute.KeyValue
+
+	messageCounter    metric.Int64Counter
+	durationHistogram metric.Float64Histogram
+}
+
+// NewHandlerMetrics creates the handler instruments using the package meter.
+func NewHandlerMetrics(name string) (*HandlerMetrics, error) {
+	m := &HandlerMetrics{
+		attributes: []attribute.KeyValue{
+			semconv.MessagingSystemKafka,
+			handlerNameKey.String(name),
+		},
+	}
+
+	var err error
+	m.messageCounter, err = meter.Int64Counter(
+		handlerMessagesName,
+		metric.WithUnit("{message}"),
+		metric.WithDescription("Number of messages handled by a message handler."),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	m.durationHistogram, err = meter.Float64Histogram(
+		handlerDurationName,
+		metric.WithUnit("s"),
+		metric.WithDescription("Duration of handling a message by a message handler."),
+		metric.WithExplicitBucketBoundaries(sdk.HistogramBoundariesSeconds()...),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// RecordHandled counts msg and records how long it was handled, tagged with error.type on failure.
+func (m *HandlerMetrics) RecordHandled(ctx context.Context, msg *kafka.Message, duration time.Duration, err error) {
+	attrs := slices.Concat(m.attributes, []attribute.KeyValue{
+		semconv.MessagingDestinationName(*msg.TopicPartition.Topic),
+	})
+	if err != nil {
+		attrs = append(attrs, semconv.ErrorTypeKey.String(ErrorType(err)))
+	}
+
+	opt := metric.WithAttributes(attrs...)
+	m.messageCounter.Add(ctx, 1, opt)
+	m.durationHistogram.Record(ctx, duration.Seconds(), opt)
+}
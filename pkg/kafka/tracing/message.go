@@ -1,11 +1,21 @@
 package tracing
 
 import (
+	"context"
+	"strings"
+
 	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
 	"go.opentelemetry.io/otel/propagation"
 )
 
-var _ propagation.TextMapCarrier = (*MessageCarrier)(nil)
+// producerHeaderPrefix prefixes the headers which keep the trace context propagated by
+// the producer, once Consumer.Poll replaced it with the receive span.
+const producerHeaderPrefix = "x-producer-"
+
+var (
+	_ propagation.TextMapCarrier = (*MessageCarrier)(nil)
+	_ propagation.TextMapCarrier = (*prefixedCarrier)(nil)
+)
 
 type MessageCarrier struct {
 	msg *kafka.Message
@@ -45,3 +55,43 @@ func (c MessageCarrier) Keys() []string {
 	}
 	return out
 }
+
+// ContextFromMessage returns a copy of ctx carrying the span context and baggage
+// propagated in the headers of msg.
+func ContextFromMessage(ctx context.Context, msg *kafka.Message) context.Context {
+	return propagator.Extract(ctx, NewMessageCarrier(msg))
+}
+
+// ProducerContextFromMessage returns a copy of ctx carrying the span context and baggage
+// propagated by the producer of msg, even after Consumer.Poll injected the receive span.
+func ProducerContextFromMessage(ctx context.Context, msg *kafka.Message) context.Context {
+	carrier := prefixedCarrier{MessageCarrier: NewMessageCarrier(msg), prefix: producerHeaderPrefix}
+	if len(carrier.Keys()) == 0 {
+		return ContextFromMessage(ctx, msg)
+	}
+	return propagator.Extract(ctx, carrier)
+}
+
+// prefixedCarrier reads and writes the headers of a message under a prefix.
+type prefixedCarrier struct {
+	*MessageCarrier
+	prefix string
+}
+
+func (c prefixedCarrier) Get(key string) string {
+	return c.MessageCarrier.Get(c.prefix + key)
+}
+
+func (c prefixedCarrier) Set(key string, value string) {
+	c.MessageCarrier.Set(c.prefix+key, value)
+}
+
+func (c prefixedCarrier) Keys() []string {
+	var out []string
+	for _, key := range c.MessageCarrier.Keys() {
+		if strings.HasPrefix(key, c.prefix) {
+			out = append(out, strings.TrimPrefix(key, c.prefix))
+		}
+	}
+	return out
+}
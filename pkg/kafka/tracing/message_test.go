@@ -0,0 +1,34 @@
+package tracing
+
+import (
+	"context"
+	"testing"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestProducerContextFromMessage(t *testing.T) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	otel.SetTracerProvider(sdktrace.NewTracerProvider())
+
+	topic := "movie.rating"
+	producerTraceparent := "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	msg := &kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &topic},
+		Headers:        []kafka.Header{{Key: "traceparent", Value: []byte(producerTraceparent)}},
+	}
+
+	(&Consumer{}).traceReceive(msg)
+	EndReceiveSpan(msg, nil)
+
+	producer := trace.SpanContextFromContext(ProducerContextFromMessage(context.Background(), msg))
+	receive := trace.SpanContextFromContext(ContextFromMessage(context.Background(), msg))
+	require.Equal(t, "b7ad6b7169203331", producer.SpanID().String())
+	require.Equal(t, producer.TraceID(), receive.TraceID())
+	require.NotEqual(t, producer.SpanID(), receive.SpanID())
+}
@@ -0,0 +1,311 @@
+package tracing
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/vncats/otel-demo/pkg/otel/sdk"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+const (
+	consumerCommitsName            = "messaging.kafka.consumer.commits"
+	consumerRebalancesName         = "messaging.kafka.consumer.rebalances"
+	consumerRebalanceDurationName  = "messaging.kafka.consumer.rebalance.duration"
+	consumerPollIdleTimeName       = "messaging.kafka.consumer.poll.idle_time"
+	consumerLagName                = "messaging.kafka.consumer.lag"
+	consumerAssignedPartitionsName = "messaging.kafka.consumer.assigned_partitions"
+	consumerDuplicatesName         = "messaging.kafka.consumer.duplicates"
+)
+
+var rebalanceTypeKey = attribute.Key("messaging.kafka.rebalance.type")
+
+// ConsumerMetrics records consumer metrics which are not bound to the span of a single message.
+type ConsumerMetrics struct {
+	consumer   *kafka.Consumer
+	attributes []attribute.KeyValue
+
+	commitCounter     metric.Int64Counter
+	rebalanceCounter  metric.Int64Counter
+	rebalanceDuration metric.Float64Histogram
+	pollIdleTime      metric.Float64Counter
+	lagGauge          metric.Int64ObservableGauge
+	assignedGauge     metric.Int64ObservableGauge
+
+	registration metric.Registration
+
+	// committed caches the committed offset of every partition, so that observing the lag
+	// does not query the broker.
+	mu        sync.Mutex
+	committed map[partition]kafka.Offset
+}
+
+type partition struct {
+	topic     string
+	partition int32
+}
+
+// NewConsumerMetrics creates the consumer instruments using the package meter. The lag and
+// assignment of c are observed on every collection until Close is called, from the
+// committed offsets reported with RecordCommit and RecordCommitted.
+func NewConsumerMetrics(c *kafka.Consumer, opts WrapOptions) (*ConsumerMetrics, error) {
+	m := &ConsumerMetrics{
+		consumer:   c,
+		attributes: opts.Attributes,
+		committed:  make(map[partition]kafka.Offset),
+	}
+
+	var err error
+	m.commitCounter, err = meter.Int64Counter(
+		consumerCommitsName,
+		metric.WithUnit("{commit}"),
+		metric.WithDescription("Number of partition offset commits attempted by the consumer."),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	m.rebalanceCounter, err = meter.Int64Counter(
+		consumerRebalancesName,
+		metric.WithUnit("{rebalance}"),
+		metric.WithDescription("Number of partition assignments and revocations received by the consumer."),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	m.rebalanceDuration, err = meter.Float64Histogram(
+		consumerRebalanceDurationName,
+		metric.WithUnit("s"),
+		metric.WithDescription("Time from joining the group or losing partitions until partitions are assigned."),
+		metric.WithExplicitBucketBoundaries(sdk.HistogramBoundariesSeconds()...),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	m.pollIdleTime, err = meter.Float64Counter(
+		consumerPollIdleTimeName,
+		metric.WithUnit("s"),
+		metric.WithDescription("Time spent in poll calls which returned no event."),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	m.lagGauge, err = meter.Int64ObservableGauge(
+		consumerLagName,
+		metric.WithUnit("{message}"),
+		metric.WithDescription("Difference between the high watermark and the committed offset of an assigned partition."),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	m.assignedGauge, err = meter.Int64ObservableGauge(
+		consumerAssignedPartitionsName,
+		metric.WithUnit("{partition}"),
+		metric.WithDescription("Number of partitions currently assigned to the consumer."),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	m.registration, err = meter.RegisterCallback(m.observe, m.lagGauge, m.assignedGauge)
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// Close stops observing the consumer. It must be called before the consumer is closed.
+func (m *ConsumerMetrics) Close() error {
+	return m.registration.Unregister()
+}
+
+// RecordCommit counts one commit per partition, tagging failed partitions with error.type.
+func (m *ConsumerMetrics) RecordCommit(ctx context.Context, offsets []kafka.TopicPartition, err error) {
+	for _, tp := range offsets {
+		attrs := slices.Concat(m.attributes, partitionAttrs(tp))
+		if tpErr := cmp.Or(err, tp.Error); tpErr != nil {
+			attrs = append(attrs, semconv.ErrorTypeKey.String(ErrorType(tpErr)))
+		}
+		m.commitCounter.Add(ctx, 1, metric.WithAttributes(attrs...))
+	}
+
+	if err == nil {
+		m.RecordCommitted(offsets)
+	}
+}
+
+// RecordCommitted caches the committed offsets of partitions, as fetched on assignment or
+// committed in the background by librdkafka. Partitions which failed to commit are ignored.
+func (m *ConsumerMetrics) RecordCommitted(offsets []kafka.TopicPartition) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, tp := range offsets {
+		if tp.Error == nil && tp.Topic != nil {
+			m.committed[partition{topic: *tp.Topic, partition: tp.Partition}] = tp.Offset
+		}
+	}
+}
+
+// ForgetCommitted drops the committed offsets of revoked partitions.
+func (m *ConsumerMetrics) ForgetCommitted(partitions []kafka.TopicPartition) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, tp := range partitions {
+		delete(m.committed, partition{topic: *tp.Topic, partition: tp.Partition})
+	}
+}
+
+// RecordRebalance counts a rebalance event of the given type, "assigned" or "revoked",
+// and records its duration when positive.
+func (m *ConsumerMetrics) RecordRebalance(ctx context.Context, rebalanceType string, duration time.Duration) {
+	attrs := metric.WithAttributes(slices.Concat(m.attributes, []attribute.KeyValue{
+		rebalanceTypeKey.String(rebalanceType),
+	})...)
+
+	m.rebalanceCounter.Add(ctx, 1, attrs)
+	if duration > 0 {
+		m.rebalanceDuration.Record(ctx, duration.Seconds(), attrs)
+	}
+}
+
+// RecordPollIdle adds the duration of a poll call which returned no event.
+func (m *ConsumerMetrics) RecordPollIdle(ctx context.Context, duration time.Duration) {
+	m.pollIdleTime.Add(ctx, duration.Seconds(), metric.WithAttributes(m.attributes...))
+}
+
+func (m *ConsumerMetrics) observe(_ context.Context, o metric.Observer) error {
+	assigned, err := m.consumer.Assignment()
+	if err != nil {
+		return err
+	}
+	o.ObserveInt64(m.assignedGauge, int64(len(assigned)), metric.WithAttributes(m.attributes...))
+	if len(assigned) == 0 {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, tp := range assigned {
+		offset, ok := m.committed[partition{topic: *tp.Topic, partition: tp.Partition}]
+		if !ok {
+			// the committed offset is not known yet
+			continue
+		}
+		tp.Offset = offset
+
+		low, high, err := m.consumer.GetWatermarkOffsets(*tp.Topic, tp.Partition)
+		if err != nil || high < 0 {
+			// no fetch response received for the partition yet
+			continue
+		}
+
+		lag := high - int64(tp.Offset)
+		if tp.Offset < 0 {
+			// nothing committed yet, so everything retained is lagging
+			lag = high - max(low, 0)
+		}
+		o.ObserveInt64(m.lagGauge, max(lag, 0), metric.WithAttributes(slices.Concat(m.attributes, partitionAttrs(tp))...))
+	}
+
+	return nil
+}
+
+// ErrorType returns a low-cardinality value for the error.type attribute.
+func ErrorType(err error) string {
+	var kErr kafka.Error
+	if errors.As(err, &kErr) {
+		return kErr.Code().String()
+	}
+	return fmt.Sprintf("%T", err)
+}
+
+func partitionAttrs(tp kafka.TopicPartition) []attribute.KeyValue {
+	var attrs []attribute.KeyValue
+	if tp.Topic != nil {
+		attrs = append(attrs, semconv.MessagingDestinationName(*tp.Topic))
+	}
+	return append(attrs, semconv.MessagingDestinationPartitionID(strconv.Itoa(int(tp.Partition))))
+}
+
+// ProducerMetrics records the outcome of produced messages, whether traced or not.
+type ProducerMetrics struct {
+	attributes       []attribute.KeyValue
+	publishedCounter metric.Int64Counter
+}
+
+// NewProducerMetrics creates the producer instruments using the package meter.
+func NewProducerMetrics(opts WrapOptions) (*ProducerMetrics, error) {
+	m := &ProducerMetrics{
+		attributes: opts.Attributes,
+	}
+
+	var err error
+	m.publishedCounter, err = meter.Int64Counter(
+		semconv.MessagingPublishMessagesName,
+		metric.WithUnit(semconv.MessagingPublishMessagesUnit),
+		metric.WithDescription(semconv.MessagingPublishMessagesDescription),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// RecordDelivery counts a delivery report, tagging failed deliveries with error.type.
+func (m *ProducerMetrics) RecordDelivery(ctx context.Context, msg *kafka.Message) {
+	attrs := slices.Concat(m.attributes, []attribute.KeyValue{
+		semconv.MessagingSystemKafka,
+		semconv.MessagingDestinationName(*msg.TopicPartition.Topic),
+	})
+	if err := msg.TopicPartition.Error; err != nil {
+		attrs = append(attrs, semconv.ErrorTypeKey.String(ErrorType(err)))
+	}
+	m.publishedCounter.Add(ctx, 1, metric.WithAttributes(attrs...))
+}
+
+// DedupMetrics counts the messages dropped by the deduplication of a consumer.
+type DedupMetrics struct {
+	duplicateCounter metric.Int64Counter
+}
+
+// NewDedupMetrics creates the deduplication instruments using the package meter.
+func NewDedupMetrics() (*DedupMetrics, error) {
+	m := &DedupMetrics{}
+
+	var err error
+	m.duplicateCounter, err = meter.Int64Counter(
+		consumerDuplicatesName,
+		metric.WithUnit("{message}"),
+		metric.WithDescription("Number of consumed messages dropped because they were already processed."),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// RecordDuplicate counts a message dropped as a duplicate.
+func (m *DedupMetrics) RecordDuplicate(ctx context.Context, msg *kafka.Message) {
+	m.duplicateCounter.Add(ctx, 1, metric.WithAttributes(slices.Concat([]attribute.KeyValue{
+		semconv.MessagingSystemKafka,
+	}, partitionAttrs(msg.TopicPartition))...))
+}
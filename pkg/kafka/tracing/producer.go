@@ -3,30 +3,52 @@ package tracing
 import (
 	"context"
 	"fmt"
+	"slices"
+	"sync"
+	"time"
 
 	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/vncats/otel-demo/pkg/otel/sdk"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
 	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
 	"go.opentelemetry.io/otel/trace"
 )
 
 // WrapProducer wraps a kafka.Producer so that any produced messages are traced.
-func WrapProducer(p *kafka.Producer, opts WrapOptions) *Producer {
-	return &Producer{
+func WrapProducer(p *kafka.Producer, opts WrapOptions) (*Producer, error) {
+	producer := &Producer{
 		Producer:   p,
 		attributes: opts.Attributes,
 	}
+	if err := producer.createMetrics(); err != nil {
+		return nil, err
+	}
+
+	return producer, nil
 }
 
 type Producer struct {
 	*kafka.Producer
-	attributes []attribute.KeyValue
+	attributes        []attribute.KeyValue
+	durationHistogram metric.Float64Histogram
+
+	eventsOnce sync.Once
+	events     chan kafka.Event
 }
 
-// Produce calls the underlying Producer.Produce and traces the request.
+// spanOpaque stands in for the opaque of a message produced without delivery channel
+// until its delivery report arrives on the events channel.
+type spanOpaque struct {
+	end    func(err error)
+	opaque interface{}
+}
+
+// Produce calls the underlying Producer.Produce and traces the request. The span ends
+// when the delivery report is received, either on deliveryChan or on Events.
 func (p *Producer) Produce(msg *kafka.Message, deliveryChan chan kafka.Event) error {
-	span := p.startSpan(msg)
+	end := p.startSpan(msg)
 
 	// if the user has selected a delivery channel, we will wrap it and
 	// wait for the delivery event to finish the span
@@ -36,47 +58,100 @@ func (p *Producer) Produce(msg *kafka.Message, deliveryChan chan kafka.Event) er
 		go func() {
 			evt := <-deliveryChan
 			if resMsg, ok := evt.(*kafka.Message); ok {
-				if err := resMsg.TopicPartition.Error; err != nil {
-					span.RecordError(resMsg.TopicPartition.Error)
-					span.SetStatus(codes.Error, err.Error())
-				}
+				end(resMsg.TopicPartition.Error)
+			} else {
+				end(nil)
 			}
-			span.End()
 			oldDeliveryChan <- evt
 		}()
+	} else {
+		msg.Opaque = &spanOpaque{end: end, opaque: msg.Opaque}
 	}
 
 	err := p.Producer.Produce(msg, deliveryChan)
 
-	// with no delivery channel or enqueue error, finish immediately
-	if err != nil || deliveryChan == nil {
-		span.RecordError(err)
-		span.End()
+	// the delivery report never arrives if the message could not be enqueued
+	if err != nil {
+		if so, ok := msg.Opaque.(*spanOpaque); ok {
+			msg.Opaque = so.opaque
+		}
+		end(err)
 	}
 
 	return err
 }
 
-func (p *Producer) startSpan(msg *kafka.Message) trace.Span {
+// Events returns the events channel of the underlying producer, ending the span of
+// each delivered message and restoring its original opaque before forwarding it.
+func (p *Producer) Events() chan kafka.Event {
+	p.eventsOnce.Do(func() {
+		src := p.Producer.Events()
+		p.events = make(chan kafka.Event, cap(src))
+		go func() {
+			defer close(p.events)
+			for evt := range src {
+				if msg, ok := evt.(*kafka.Message); ok {
+					if so, ok := msg.Opaque.(*spanOpaque); ok {
+						msg.Opaque = so.opaque
+						so.end(msg.TopicPartition.Error)
+					}
+				}
+				p.events <- evt
+			}
+		}()
+	})
+
+	return p.events
+}
+
+func (p *Producer) startSpan(msg *kafka.Message) func(err error) {
 	carrier := NewMessageCarrier(msg)
 	parentCtx := propagator.Extract(context.Background(), carrier)
 
-	attrs := append(
-		p.attributes,
+	operationName := fmt.Sprintf("send %s", *msg.TopicPartition.Topic)
+	attrs := slices.Concat(p.attributes, []attribute.KeyValue{
+		semconv.MessagingOperationName(operationName),
 		semconv.MessagingOperationTypePublish,
 		semconv.MessagingSystemKafka,
 		semconv.MessagingDestinationName(*msg.TopicPartition.Topic),
-		semconv.MessagingKafkaMessageKey(string(msg.Key)),
-		semconv.MessagingMessageBodySize(getMsgSize(msg)),
-	)
+	})
 
+	startTime := time.Now()
 	spanCtx, span := tracer.Start(
 		parentCtx,
-		fmt.Sprintf("send %s", *msg.TopicPartition.Topic),
-		trace.WithAttributes(attrs...),
+		operationName,
+		trace.WithTimestamp(startTime),
+		trace.WithAttributes(slices.Concat(attrs, []attribute.KeyValue{
+			semconv.MessagingKafkaMessageKey(string(msg.Key)),
+			semconv.MessagingMessageBodySize(getMsgSize(msg)),
+		})...),
 		trace.WithSpanKind(trace.SpanKindProducer),
 	)
 	propagator.Inject(spanCtx, carrier)
 
-	return span
+	return func(err error) {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			attrs = append(slices.Clip(attrs), semconv.ErrorTypeKey.String(ErrorType(err)))
+		}
+		p.durationHistogram.Record(spanCtx, time.Since(startTime).Seconds(), metric.WithAttributes(attrs...))
+		span.End()
+	}
+}
+
+func (p *Producer) createMetrics() error {
+	var err error
+
+	p.durationHistogram, err = meter.Float64Histogram(
+		semconv.MessagingPublishDurationName,
+		metric.WithUnit(semconv.MessagingPublishDurationUnit),
+		metric.WithDescription(semconv.MessagingPublishDurationDescription),
+		metric.WithExplicitBucketBoundaries(sdk.HistogramBoundariesSeconds()...),
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
 }
@@ -0,0 +1,57 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	rebalanceProtocolKey   = attribute.Key("messaging.kafka.rebalance.protocol")
+	rebalancePartitionsKey = attribute.Key("messaging.kafka.rebalance.partitions")
+	rebalanceLostKey       = attribute.Key("messaging.kafka.rebalance.assignment_lost")
+)
+
+// StartRebalanceSpan starts a span for handling a rebalance event of the given type,
+// "assigned" or "revoked". The returned function ends the span, recording err.
+func (c *Consumer) StartRebalanceSpan(ctx context.Context, rebalanceType string, partitions []kafka.TopicPartition) (context.Context, func(err error)) {
+	attrs := slices.Concat(c.attributes, []attribute.KeyValue{
+		semconv.MessagingSystemKafka,
+		rebalanceTypeKey.String(rebalanceType),
+		rebalanceProtocolKey.String(c.GetRebalanceProtocol()),
+		rebalancePartitionsKey.StringSlice(FormatPartitions(partitions)),
+	})
+	if rebalanceType == "revoked" {
+		attrs = append(attrs, rebalanceLostKey.Bool(c.AssignmentLost()))
+	}
+
+	spanCtx, span := tracer.Start(
+		ctx,
+		fmt.Sprintf("rebalance %s", rebalanceType),
+		trace.WithAttributes(attrs...),
+		trace.WithSpanKind(trace.SpanKindInternal),
+	)
+
+	return spanCtx, func(err error) {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+}
+
+// FormatPartitions returns each partition as "topic[partition]".
+func FormatPartitions(partitions []kafka.TopicPartition) []string {
+	out := make([]string, len(partitions))
+	for i, tp := range partitions {
+		out[i] = fmt.Sprintf("%s[%d]", *tp.Topic, tp.Partition)
+	}
+	return out
+}
@@ -0,0 +1,143 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/vncats/otel-demo/pkg/kafka/tracing"
+	"github.com/vncats/otel-demo/pkg/otel/log"
+	"github.com/vncats/otel-demo/pkg/retry"
+)
+
+const defaultTransactionInitTimeout = 30 * time.Second
+
+// transactionCommitRetry retries a commit failing with a retriable error a few times,
+// backing off in between, before the transaction is aborted.
+var transactionCommitRetry = retry.Config{
+	Name:            "kafka transaction commit",
+	InitialInterval: 100 * time.Millisecond,
+	MaxInterval:     2 * time.Second,
+	Multiplier:      2,
+	MaxRetries:      5,
+	IsRetryable: func(err error) bool {
+		var kerr kafka.Error
+		return errors.As(err, &kerr) && kerr.IsRetriable()
+	},
+}
+
+var ErrNotTransactional = errors.New("producer has no transactional id")
+
+type transactionalClient interface {
+	InitTransactions(ctx context.Context) error
+	BeginTransaction() error
+	SendOffsetsToTransaction(ctx context.Context, offsets []kafka.TopicPartition, consumerMetadata *kafka.ConsumerGroupMetadata) error
+	CommitTransaction(ctx context.Context) error
+	AbortTransaction(ctx context.Context) error
+}
+
+var (
+	_ transactionalClient = (*kafka.Producer)(nil)
+	_ transactionalClient = (*tracing.Producer)(nil)
+)
+
+// BeginTransaction starts a transaction. Every message produced until it is committed
+// or aborted belongs to the transaction.
+func (p *Producer) BeginTransaction() error {
+	if p.txn == nil {
+		return ErrNotTransactional
+	}
+	return p.txn.BeginTransaction()
+}
+
+// CommitTransaction flushes the messages of the current transaction and commits it.
+func (p *Producer) CommitTransaction(ctx context.Context) error {
+	if p.txn == nil {
+		return ErrNotTransactional
+	}
+	return p.txn.CommitTransaction(ctx)
+}
+
+// AbortTransaction purges the messages of the current transaction and aborts it.
+func (p *Producer) AbortTransaction(ctx context.Context) error {
+	if p.txn == nil {
+		return ErrNotTransactional
+	}
+	return p.txn.AbortTransaction(ctx)
+}
+
+// SendOffsetsToTransaction commits the consumer offsets of a group as part of the
+// current transaction, see Consumer.SendOffsetsToTransaction.
+func (p *Producer) SendOffsetsToTransaction(ctx context.Context, offsets []kafka.TopicPartition, group *kafka.ConsumerGroupMetadata) error {
+	if p.txn == nil {
+		return ErrNotTransactional
+	}
+	return p.txn.SendOffsetsToTransaction(ctx, offsets, group)
+}
+
+// Transaction runs fn within a transaction, which is committed if fn returns nil and
+// aborted otherwise. A commit failing with a retriable error is retried with a backoff, up
+// to 5 times and until ctx is done.
+func (p *Producer) Transaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	if err := p.BeginTransaction(); err != nil {
+		return err
+	}
+
+	if err := fn(ctx); err != nil {
+		return errors.Join(err, p.abort(ctx))
+	}
+
+	err := retry.DoCtx(ctx, p.CommitTransaction, transactionCommitRetry)
+	if err != nil {
+		return errors.Join(err, p.abort(ctx))
+	}
+
+	return nil
+}
+
+func (p *Producer) abort(ctx context.Context) error {
+	// the transaction must be aborted even when ctx is the reason it failed
+	err := p.AbortTransaction(context.WithoutCancel(ctx))
+	if err != nil {
+		log.Error(ctx, "failed to abort transaction", "error", err)
+	}
+	return err
+}
+
+// SendOffsetsToTransaction commits the offsets following msgs in the current transaction
+// of p, so that they are consumed exactly once along with the messages p produced.
+func (c *Consumer) SendOffsetsToTransaction(ctx context.Context, p *Producer, msgs ...*kafka.Message) error {
+	group, err := c.client.GetConsumerGroupMetadata()
+	if err != nil {
+		return err
+	}
+
+	positions := make(map[partitionKey]kafka.Offset)
+	for _, msg := range msgs {
+		key := keyOf(msg.TopicPartition)
+		positions[key] = max(positions[key], msg.TopicPartition.Offset+1)
+	}
+
+	offsets := make([]kafka.TopicPartition, 0, len(positions))
+	for key, offset := range positions {
+		offsets = append(offsets, key.topicPartition(offset))
+	}
+
+	return p.SendOffsetsToTransaction(ctx, offsets, group)
+}
+
+// transact calls fn within a transaction of the consumer's transactional producer, along
+// with the offsets of msgs, when the commit mode is CommitModeTransaction.
+func (c *Consumer) transact(ctx context.Context, msgs []*kafka.Message, fn func(ctx context.Context) error) error {
+	if c.transactional == nil {
+		return fn(ctx)
+	}
+
+	return c.transactional.Transaction(ctx, func(ctx context.Context) error {
+		if err := fn(ctx); err != nil {
+			return err
+		}
+		return c.SendOffsetsToTransaction(ctx, c.transactional, msgs...)
+	})
+}
@@ -0,0 +1,91 @@
+package retry
+
+import (
+	"context"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"golang.org/x/time/rate"
+)
+
+const (
+	defaultBudgetRatio      = 0.1
+	defaultBudgetMinPerSec  = 10
+	defaultBudgetMaxBalance = 100
+)
+
+var budgetKey = attribute.Key("retry.budget")
+
+type BudgetOptions struct {
+	// Name identifies the budget in metrics.
+	Name string
+	// Ratio is the share of operations which may be retried, 0.1 by default.
+	Ratio float64
+	// MinRetriesPerSecond are always allowed regardless of Ratio, so that a low traffic
+	// still gets retried. Defaults to 10.
+	MinRetriesPerSecond int
+	// MaxBalance caps the retries saved up while everything succeeds, 100 by default.
+	MaxBalance float64
+}
+
+// Budget limits retries to a share of the operations, shared by every Config using it,
+// so that retries do not multiply the load on a dependency which is already failing.
+// Every operation deposits Ratio tokens and every retry withdraws one.
+type Budget struct {
+	ratio      float64
+	maxBalance float64
+	reserve    *rate.Limiter
+	attrs      metric.MeasurementOption
+
+	mu      sync.Mutex
+	balance float64
+}
+
+func NewBudget(opts BudgetOptions) *Budget {
+	if opts.Ratio <= 0 {
+		opts.Ratio = defaultBudgetRatio
+	}
+
+	if opts.MinRetriesPerSecond <= 0 {
+		opts.MinRetriesPerSecond = defaultBudgetMinPerSec
+	}
+
+	if opts.MaxBalance <= 0 {
+		opts.MaxBalance = defaultBudgetMaxBalance
+	}
+
+	return &Budget{
+		ratio:      opts.Ratio,
+		maxBalance: opts.MaxBalance,
+		reserve:    rate.NewLimiter(rate.Limit(opts.MinRetriesPerSecond), opts.MinRetriesPerSecond),
+		attrs:      metric.WithAttributes(budgetKey.String(opts.Name)),
+	}
+}
+
+func (b *Budget) deposit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.balance = min(b.balance+b.ratio, b.maxBalance)
+}
+
+// withdraw reports whether a retry is allowed, recording the exhaustion of the budget otherwise.
+func (b *Budget) withdraw(ctx context.Context) bool {
+	if b.reserve.Allow() {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.balance >= 1 {
+		b.balance--
+		return true
+	}
+
+	if budgetExhaustedCounter != nil {
+		budgetExhaustedCounter.Add(context.WithoutCancel(ctx), 1, b.attrs)
+	}
+	return false
+}
@@ -0,0 +1,110 @@
+package retry
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	defaultHedgeMaxRequests = 2
+	hedgeEventName          = "hedge"
+)
+
+type HedgeConfig struct {
+	// Name identifies the operation in metrics.
+	Name string
+	// Delay is how long to wait for a request before starting another one.
+	Delay time.Duration
+	// MaxRequests is the number of requests started at most, the first one included. It defaults to 2.
+	MaxRequests int
+	// Budget, when set, limits the hedged requests of every operation sharing it.
+	Budget *Budget
+}
+
+type hedgeResult[T any] struct {
+	value T
+	err   error
+}
+
+// Hedge calls fn and, if it did not succeed within cfg.Delay or failed, calls it again
+// concurrently, up to cfg.MaxRequests times. The first successful result is returned and
+// the context of the other requests is cancelled. fn must be idempotent.
+func Hedge[T any](ctx context.Context, cfg HedgeConfig, fn func(ctx context.Context) (T, error)) (T, error) {
+	if cfg.MaxRequests <= 0 {
+		cfg.MaxRequests = defaultHedgeMaxRequests
+	}
+	if cfg.Budget != nil {
+		cfg.Budget.deposit()
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// buffered so that the requests which lost never block
+	results := make(chan hedgeResult[T], cfg.MaxRequests)
+	started, pending := 0, 0
+	start := func() bool {
+		if started == cfg.MaxRequests {
+			return false
+		}
+		if started > 0 {
+			if cfg.Budget != nil && !cfg.Budget.withdraw(ctx) {
+				return false
+			}
+			cfg.recordHedge(ctx, started+1)
+		}
+
+		started++
+		pending++
+		go func() {
+			value, err := fn(ctx)
+			results <- hedgeResult[T]{value: value, err: err}
+		}()
+		return true
+	}
+	start()
+
+	timer := time.NewTimer(cfg.Delay)
+	defer timer.Stop()
+
+	var zero T
+	var lastErr error
+	for {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				return r.value, nil
+			}
+			lastErr = r.err
+			if (IsPermanent(r.err) || !start()) && pending == 0 {
+				return zero, lastErr
+			}
+		case <-timer.C:
+			if start() {
+				timer.Reset(cfg.Delay)
+			}
+		case <-ctx.Done():
+			if lastErr != nil {
+				return zero, fmt.Errorf("%w: %w", ctx.Err(), lastErr)
+			}
+			return zero, ctx.Err()
+		}
+	}
+}
+
+func (cfg HedgeConfig) recordHedge(ctx context.Context, request int) {
+	attrs := metric.WithAttributes(operationKey.String(cfg.Name))
+	if hedgesCounter != nil {
+		hedgesCounter.Add(ctx, 1, attrs)
+	}
+
+	trace.SpanFromContext(ctx).AddEvent(hedgeEventName, trace.WithAttributes(
+		operationKey.String(cfg.Name),
+		attemptKey.Int(request),
+	))
+}
@@ -1,28 +1,237 @@
 package retry
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"time"
 
 	"github.com/cenkalti/backoff/v4"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
+const (
+	scopeName           = "github.com/vncats/otel-demo/retry"
+	attemptsName        = "retry.attempts"
+	budgetExhaustedName = "retry.budget.exhausted"
+	hedgesName          = "retry.hedges"
+	attemptEventName    = "retry"
+)
+
+// Outcomes of an attempt, recorded as the retry.outcome attribute.
+const (
+	OutcomeSuccess   = "success"
+	OutcomeRetry     = "retry"
+	OutcomePermanent = "permanent"
+	OutcomeExhausted = "exhausted"
+	OutcomeCancelled = "cancelled"
+	OutcomeNoBudget  = "no_budget"
+)
+
+var (
+	operationKey = attribute.Key("retry.operation")
+	outcomeKey   = attribute.Key("retry.outcome")
+	attemptKey   = attribute.Key("retry.attempt")
+	delayKey     = attribute.Key("retry.delay")
+)
+
+var (
+	meter                  = otel.Meter(scopeName)
+	attemptsCounter        metric.Int64Counter
+	budgetExhaustedCounter metric.Int64Counter
+	hedgesCounter          metric.Int64Counter
+)
+
+func init() {
+	var err error
+	attemptsCounter, err = meter.Int64Counter(
+		attemptsName,
+		metric.WithUnit("{attempt}"),
+		metric.WithDescription("Number of attempts of retried operations, by outcome."),
+	)
+	if err != nil {
+		otel.Handle(err)
+	}
+
+	budgetExhaustedCounter, err = meter.Int64Counter(
+		budgetExhaustedName,
+		metric.WithUnit("{retry}"),
+		metric.WithDescription("Number of retries denied because the retry budget was exhausted."),
+	)
+	if err != nil {
+		otel.Handle(err)
+	}
+
+	hedgesCounter, err = meter.Int64Counter(
+		hedgesName,
+		metric.WithUnit("{request}"),
+		metric.WithDescription("Number of hedged requests started after the first one."),
+	)
+	if err != nil {
+		otel.Handle(err)
+	}
+}
+
 type Config struct {
+	// Name identifies the operation in metrics.
+	Name string
+
 	InitialInterval time.Duration
 	MaxInterval     time.Duration
 	Multiplier      float64
-	Timeout         time.Duration
-	MaxRetries      uint64
+	// Timeout bounds the total time spent on all attempts and the delays between them.
+	Timeout    time.Duration
+	MaxRetries uint64
+	// Jitter randomizes each delay by up to this factor, e.g. 0.2 for ±20%. It defaults to
+	// 0.5 and a negative value disables it.
+	Jitter float64
+
+	// IsRetryable reports whether an error is worth retrying. By default every error
+	// is retried, except the ones wrapped with Permanent.
+	IsRetryable func(err error) bool
+
+	// Budget, when set, limits the retries of every operation sharing it.
+	Budget *Budget
 }
 
 func (cfg Config) ToBackOff() backoff.BackOff {
-	var bo backoff.BackOff = backoff.NewExponentialBackOff(
+	opts := []backoff.ExponentialBackOffOpts{
 		backoff.WithInitialInterval(cfg.InitialInterval),
 		backoff.WithMaxInterval(cfg.MaxInterval),
 		backoff.WithMultiplier(cfg.Multiplier),
-	)
+	}
+	if cfg.Timeout > 0 {
+		opts = append(opts, backoff.WithMaxElapsedTime(cfg.Timeout))
+	}
+	if cfg.Jitter != 0 {
+		opts = append(opts, backoff.WithRandomizationFactor(max(cfg.Jitter, 0)))
+	}
+
+	var bo backoff.BackOff = backoff.NewExponentialBackOff(opts...)
 	return backoff.WithMaxRetries(bo, cfg.MaxRetries)
 }
 
+// PermanentError signals that an operation must not be retried.
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+// Permanent wraps err so that it is not retried. It returns nil if err is nil.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &PermanentError{Err: err}
+}
+
+// IsPermanent reports whether err was wrapped with Permanent.
+func IsPermanent(err error) bool {
+	var permanent *PermanentError
+	return errors.As(err, &permanent)
+}
+
 func Do(op func() error, cfg Config) error {
-	return backoff.Retry(op, cfg.ToBackOff())
+	return DoCtx(context.Background(), func(context.Context) error { return op() }, cfg)
+}
+
+// DoCtx calls op until it succeeds, returns an error which is not retryable or the
+// retries are exhausted, and returns the last error. Retries are also exhausted once the
+// next delay would exceed cfg.Timeout, which bounds the context of op as well. Waiting
+// between attempts stops as soon as ctx is done, in which case the context error is
+// returned along with the last one.
+//
+// Every failed attempt is recorded as an event of the span in ctx, and every attempt is
+// counted by outcome in the retry.attempts metric.
+func DoCtx(ctx context.Context, op func(ctx context.Context) error, cfg Config) error {
+	if cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.Timeout)
+		defer cancel()
+	}
+
+	bo := cfg.ToBackOff()
+	bo.Reset()
+	if cfg.Budget != nil {
+		cfg.Budget.deposit()
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := op(ctx)
+		if err == nil {
+			cfg.recordAttempt(ctx, attempt, OutcomeSuccess, 0, nil)
+			return nil
+		}
+
+		if !cfg.retryable(err) {
+			cfg.recordAttempt(ctx, attempt, OutcomePermanent, 0, err)
+			return err
+		}
+		if ctx.Err() != nil {
+			cfg.recordAttempt(ctx, attempt, OutcomeCancelled, 0, err)
+			return fmt.Errorf("%w: %w", ctx.Err(), err)
+		}
+
+		next := bo.NextBackOff()
+		if next == backoff.Stop {
+			cfg.recordAttempt(ctx, attempt, OutcomeExhausted, 0, err)
+			return err
+		}
+		if cfg.Budget != nil && !cfg.Budget.withdraw(ctx) {
+			cfg.recordAttempt(ctx, attempt, OutcomeNoBudget, 0, err)
+			return err
+		}
+		cfg.recordAttempt(ctx, attempt, OutcomeRetry, next, err)
+
+		timer := time.NewTimer(next)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("%w: %w", ctx.Err(), err)
+		case <-timer.C:
+		}
+	}
+}
+
+func (cfg Config) retryable(err error) bool {
+	if IsPermanent(err) {
+		return false
+	}
+	if cfg.IsRetryable != nil {
+		return cfg.IsRetryable(err)
+	}
+	return true
+}
+
+// recordAttempt counts an attempt and, if it failed, adds an event to the span in ctx
+// with the error and the delay before the next attempt.
+func (cfg Config) recordAttempt(ctx context.Context, attempt int, outcome string, delay time.Duration, err error) {
+	attrs := []attribute.KeyValue{outcomeKey.String(outcome)}
+	if cfg.Name != "" {
+		attrs = append(attrs, operationKey.String(cfg.Name))
+	}
+	if attemptsCounter != nil {
+		attemptsCounter.Add(context.WithoutCancel(ctx), 1, metric.WithAttributes(attrs...))
+	}
+
+	if err == nil {
+		return
+	}
+	trace.SpanFromContext(ctx).AddEvent(attemptEventName, trace.WithAttributes(append(attrs,
+		attemptKey.Int(attempt),
+		delayKey.Float64(delay.Seconds()),
+		semconv.ExceptionType(fmt.Sprintf("%T", err)),
+		semconv.ExceptionMessage(err.Error()),
+	)...))
 }
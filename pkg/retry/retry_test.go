@@ -0,0 +1,148 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestDoCtx(t *testing.T) {
+	cfg := Config{
+		InitialInterval: time.Millisecond,
+		MaxInterval:     time.Millisecond,
+		Multiplier:      1,
+		MaxRetries:      3,
+	}
+	errFailed := errors.New("failed")
+
+	attempts := 0
+	err := DoCtx(context.Background(), func(context.Context) error {
+		attempts++
+		return errFailed
+	}, cfg)
+	require.ErrorIs(t, err, errFailed)
+	require.Equal(t, 4, attempts)
+
+	attempts = 0
+	err = DoCtx(context.Background(), func(context.Context) error {
+		attempts++
+		return Permanent(errFailed)
+	}, cfg)
+	require.ErrorIs(t, err, errFailed)
+	require.True(t, IsPermanent(err))
+	require.Equal(t, 1, attempts)
+
+	attempts = 0
+	notRetryable := cfg
+	notRetryable.IsRetryable = func(err error) bool { return !errors.Is(err, errFailed) }
+	err = DoCtx(context.Background(), func(context.Context) error {
+		attempts++
+		return errFailed
+	}, notRetryable)
+	require.ErrorIs(t, err, errFailed)
+	require.Equal(t, 1, attempts)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	slow := cfg
+	slow.InitialInterval, slow.MaxInterval = time.Minute, time.Minute
+	err = DoCtx(ctx, func(context.Context) error {
+		cancel()
+		return errFailed
+	}, slow)
+	require.ErrorIs(t, err, context.Canceled)
+	require.ErrorIs(t, err, errFailed)
+}
+
+func TestDoCtxInstrumentation(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test")
+
+	ctx, span := tracer.Start(context.Background(), "op")
+	err := DoCtx(ctx, func(context.Context) error {
+		return errors.New("failed")
+	}, Config{
+		InitialInterval: 10 * time.Millisecond,
+		MaxInterval:     10 * time.Millisecond,
+		Multiplier:      1,
+		Jitter:          -1,
+		Timeout:         25 * time.Millisecond,
+		MaxRetries:      10,
+	})
+	span.End()
+	// no attempt is made once the next delay would exceed the timeout
+	require.EqualError(t, err, "failed")
+
+	events := recorder.Ended()[0].Events()
+	require.GreaterOrEqual(t, len(events), 2)
+	require.Equal(t, "retry", events[0].Name)
+	require.Contains(t, events[0].Attributes, attemptKey.Int(1))
+	require.Contains(t, events[0].Attributes, delayKey.Float64(0.01))
+	require.Contains(t, events[0].Attributes, outcomeKey.String(OutcomeRetry))
+	require.Contains(t, events[len(events)-1].Attributes, outcomeKey.String(OutcomeExhausted))
+}
+
+func TestBudget(t *testing.T) {
+	budget := NewBudget(BudgetOptions{Ratio: 0.5, MinRetriesPerSecond: 1})
+	cfg := Config{
+		InitialInterval: time.Millisecond,
+		MaxInterval:     time.Millisecond,
+		Multiplier:      1,
+		MaxRetries:      10,
+		Budget:          budget,
+	}
+
+	attempts := 0
+	failing := func(context.Context) error {
+		attempts++
+		return errors.New("failed")
+	}
+
+	// one retry from the reserve, then one from the 0.5 + 0.5 deposited by both calls
+	require.Error(t, DoCtx(context.Background(), failing, cfg))
+	require.Equal(t, 2, attempts)
+	require.Error(t, DoCtx(context.Background(), failing, cfg))
+	require.Equal(t, 4, attempts)
+	require.Error(t, DoCtx(context.Background(), failing, cfg))
+	require.Equal(t, 5, attempts)
+}
+
+func TestHedge(t *testing.T) {
+	ctx := context.Background()
+	cfg := HedgeConfig{Delay: 10 * time.Millisecond, MaxRequests: 3}
+
+	// the slow first request is overtaken by the hedged one
+	var requests atomic.Int32
+	value, err := Hedge(ctx, cfg, func(ctx context.Context) (int32, error) {
+		n := requests.Add(1)
+		if n == 1 {
+			<-ctx.Done()
+			return 0, ctx.Err()
+		}
+		return n, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, int32(2), value)
+
+	// failures are hedged right away, until MaxRequests
+	requests.Store(0)
+	_, err = Hedge(ctx, cfg, func(context.Context) (int32, error) {
+		requests.Add(1)
+		return 0, errors.New("failed")
+	})
+	require.EqualError(t, err, "failed")
+	require.Equal(t, int32(3), requests.Load())
+
+	requests.Store(0)
+	_, err = Hedge(ctx, cfg, func(context.Context) (int32, error) {
+		requests.Add(1)
+		return 0, Permanent(errors.New("failed"))
+	})
+	require.Error(t, err)
+	require.Equal(t, int32(1), requests.Load())
+}